@@ -0,0 +1,243 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// labelSeparator joins the label values of a labelSet. It is not valid UTF-8,
+// and thus cannot occur in any string decoded from JSON.
+const labelSeparator = "\xff"
+
+// labelSet holds the values of a list of labels, joined by labelSeparator, so
+// that it is safe to use as a map key.
+type labelSet string
+
+// newLabelSet creates a labelSet from the given label values.
+func newLabelSet(values ...string) labelSet {
+	return labelSet(strings.Join(values, labelSeparator))
+}
+
+// values returns the label values of the labelSet, in order.
+func (l labelSet) values() []string {
+	return strings.Split(string(l), labelSeparator)
+}
+
+// seriesKey identifies a single series of a metric within an aggregation.
+type seriesKey struct {
+	desc   *prometheus.Desc
+	labels labelSet
+}
+
+// histogram accumulates observations into buckets. Counts are kept as floats,
+// so that observations of sampled log entries can be weighted, and only
+// rounded when the histogram is reported.
+type histogram struct {
+	upperBounds []float64
+	// counts holds the number of observations in each bucket, excluding
+	// those of lower buckets; the final element is the +Inf bucket.
+	counts []float64
+	count  float64
+	sum    float64
+}
+
+// newHistogram creates an empty histogram with the given bucket upper
+// bounds, which must be sorted in increasing order.
+func newHistogram(upperBounds []float64) *histogram {
+	return &histogram{
+		upperBounds: upperBounds,
+		counts:      make([]float64, len(upperBounds)+1),
+	}
+}
+
+// observe adds an observation of v to the histogram, counted weight times.
+func (h *histogram) observe(v, weight float64) {
+	i := sort.SearchFloat64s(h.upperBounds, v)
+	h.counts[i] += weight
+	h.count += weight
+	h.sum += v * weight
+}
+
+// merge adds all observations of another histogram with the same buckets to
+// the histogram.
+func (h *histogram) merge(other *histogram) {
+	for i, n := range other.counts {
+		h.counts[i] += n
+	}
+	h.count += other.count
+	h.sum += other.sum
+}
+
+// clone returns a deep copy of the histogram.
+func (h *histogram) clone() *histogram {
+	c := *h
+	c.counts = append([]float64(nil), h.counts...)
+	return &c
+}
+
+// buckets returns the cumulative bucket counts of the histogram, in the form
+// expected by prometheus.NewConstHistogram.
+func (h *histogram) buckets() map[float64]uint64 {
+	buckets := make(map[float64]uint64, len(h.upperBounds))
+	var cumulative float64
+	for i, upperBound := range h.upperBounds {
+		cumulative += h.counts[i]
+		buckets[upperBound] = uint64(math.Round(cumulative))
+	}
+	return buckets
+}
+
+// aggregation accumulates the metrics derived from a set of log entries. Plain
+// values are reported with the value type given to collect; histograms are
+// always reported as histograms.
+type aggregation struct {
+	values     map[seriesKey]float64
+	histograms map[seriesKey]*histogram
+}
+
+// newAggregation creates an empty aggregation.
+func newAggregation() *aggregation {
+	return &aggregation{
+		values:     make(map[seriesKey]float64),
+		histograms: make(map[seriesKey]*histogram),
+	}
+}
+
+// add adds v to the value of the series with the given Desc and labels.
+func (a *aggregation) add(desc *prometheus.Desc, labels labelSet, v float64) {
+	a.values[seriesKey{desc, labels}] += v
+}
+
+// observe adds an observation of v, counted weight times, to the histogram
+// series with the given Desc and labels, creating it with the given buckets if
+// necessary.
+func (a *aggregation) observe(desc *prometheus.Desc, buckets []float64, labels labelSet, v, weight float64) {
+	key := seriesKey{desc, labels}
+	h, ok := a.histograms[key]
+	if !ok {
+		h = newHistogram(buckets)
+		a.histograms[key] = h
+	}
+	h.observe(v, weight)
+}
+
+// merge adds every series of another aggregation to the aggregation.
+func (a *aggregation) merge(other *aggregation) {
+	for key, v := range other.values {
+		a.values[key] += v
+	}
+	for key, h := range other.histograms {
+		if existing, ok := a.histograms[key]; ok {
+			existing.merge(h)
+		} else {
+			a.histograms[key] = h.clone()
+		}
+	}
+}
+
+// relabel replaces the value of the label at the given index of every plain
+// value series of the given Desc with the result of f, summing series whose
+// labels become equal.
+func (a *aggregation) relabel(desc *prometheus.Desc, index int, f func(string) string) {
+	for key, v := range a.values {
+		if key.desc != desc {
+			continue
+		}
+
+		values := key.labels.values()
+		values[index] = f(values[index])
+		newKey := seriesKey{desc, newLabelSet(values...)}
+
+		if newKey != key {
+			delete(a.values, key)
+			a.values[newKey] += v
+		}
+	}
+}
+
+// knownSeries records when a series of an aggregation was last seen, and, if
+// it is a histogram, its buckets, so that it can be zero-filled.
+type knownSeries struct {
+	lastSeen    time.Time
+	histogram   bool
+	upperBounds []float64
+}
+
+// zeroFill adds a zero value, or an empty histogram, for every series in known
+// which the aggregation lacks and which was last seen less than ttl before
+// now. It returns the series known after the aggregation, which are its own
+// series, seen at now, and the series which were zero-filled.
+func (a *aggregation) zeroFill(known map[seriesKey]knownSeries, now time.Time, ttl time.Duration) map[seriesKey]knownSeries {
+	next := make(map[seriesKey]knownSeries, len(a.values)+len(a.histograms))
+	for key := range a.values {
+		next[key] = knownSeries{lastSeen: now}
+	}
+	for key, h := range a.histograms {
+		next[key] = knownSeries{lastSeen: now, histogram: true, upperBounds: h.upperBounds}
+	}
+
+	for key, k := range known {
+		if _, ok := next[key]; ok || now.Sub(k.lastSeen) >= ttl {
+			continue
+		}
+
+		next[key] = k
+		if k.histogram {
+			a.histograms[key] = newHistogram(k.upperBounds)
+		} else {
+			a.values[key] = 0
+		}
+	}
+
+	return next
+}
+
+// translate returns a deep copy of the aggregation, in which the Desc of every
+// series is replaced by its value in descs.
+func (a *aggregation) translate(descs map[*prometheus.Desc]*prometheus.Desc) *aggregation {
+	c := newAggregation()
+	for key, v := range a.values {
+		c.values[seriesKey{descs[key.desc], key.labels}] = v
+	}
+	for key, h := range a.histograms {
+		c.histograms[seriesKey{descs[key.desc], key.labels}] = h.clone()
+	}
+	return c
+}
+
+// clone returns a deep copy of the aggregation.
+func (a *aggregation) clone() *aggregation {
+	c := newAggregation()
+	c.merge(a)
+	return c
+}
+
+// collect sends every series of the aggregation to ch, reporting plain values
+// with the given value type. The given extra label values follow those of
+// each series. If timestamp is not zero, every sample is reported with it,
+// rather than stamped with the time of the scrape.
+func (a *aggregation) collect(ch chan<- prometheus.Metric, valueType prometheus.ValueType, timestamp time.Time, extra ...string) {
+	send := func(m prometheus.Metric) {
+		if !timestamp.IsZero() {
+			m = prometheus.NewMetricWithTimestamp(timestamp, m)
+		}
+		ch <- m
+	}
+
+	for key, v := range a.values {
+		send(prometheus.MustNewConstMetric(key.desc, valueType, v, append(key.labels.values(), extra...)...))
+	}
+	for key, h := range a.histograms {
+		send(prometheus.MustNewConstHistogram(
+			key.desc,
+			uint64(math.Round(h.count)),
+			h.sum,
+			h.buckets(),
+			append(key.labels.values(), extra...)...,
+		))
+	}
+}
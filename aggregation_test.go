@@ -0,0 +1,104 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TestHistogramBuckets checks that observations on bucket boundaries are
+// counted in that bucket, and that buckets are reported cumulatively.
+func TestHistogramBuckets(t *testing.T) {
+	h := newHistogram([]float64{1, 2, 5})
+	for _, v := range []float64{0.5, 1, 1.5, 4, 10} {
+		h.observe(v, 1)
+	}
+
+	expected := map[float64]uint64{1: 2, 2: 3, 5: 4}
+	if got := h.buckets(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected buckets %v, got %v", expected, got)
+	}
+
+	if h.count != 5 || h.sum != 17 {
+		t.Errorf("expected count 5 and sum 17, got %v and %v", h.count, h.sum)
+	}
+}
+
+// TestAggregationMerge checks that merging aggregations adds their values
+// and histograms, and leaves the merged aggregation untouched.
+func TestAggregationMerge(t *testing.T) {
+	desc := prometheus.NewDesc("value", "", []string{"l"}, nil)
+	histDesc := prometheus.NewDesc("histogram", "", []string{"l"}, nil)
+	buckets := []float64{1}
+
+	a := newAggregation()
+	a.add(desc, newLabelSet("x"), 1)
+	a.observe(histDesc, buckets, newLabelSet("x"), 0.5, 1)
+
+	b := newAggregation()
+	b.add(desc, newLabelSet("x"), 2)
+	b.add(desc, newLabelSet("y"), 3)
+	b.observe(histDesc, buckets, newLabelSet("x"), 2, 1)
+	b.observe(histDesc, buckets, newLabelSet("y"), 0.5, 1)
+
+	a.merge(b)
+	a.add(desc, newLabelSet("y"), 1)
+	a.observe(histDesc, buckets, newLabelSet("y"), 0.5, 1)
+
+	if got := a.values[seriesKey{desc, newLabelSet("x")}]; got != 3 {
+		t.Errorf("expected merged value 3, got %v", got)
+	}
+
+	if got := a.values[seriesKey{desc, newLabelSet("y")}]; got != 4 {
+		t.Errorf("expected merged value 4, got %v", got)
+	}
+
+	if got := a.histograms[seriesKey{histDesc, newLabelSet("x")}].count; got != 2 {
+		t.Errorf("expected merged histogram count 2, got %v", got)
+	}
+
+	if got := b.histograms[seriesKey{histDesc, newLabelSet("y")}].count; got != 1 {
+		t.Errorf("expected merged histogram to be unchanged, got count %v", got)
+	}
+}
+
+// TestAggregationZeroFill checks that series which were seen within the TTL,
+// but are missing from an aggregation, are filled with zeros, and that they
+// are forgotten once the TTL has passed.
+func TestAggregationZeroFill(t *testing.T) {
+	desc := prometheus.NewDesc("value", "", []string{"l"}, nil)
+	histDesc := prometheus.NewDesc("histogram", "", []string{"l"}, nil)
+	buckets := []float64{1}
+	start := time.Unix(0, 0)
+
+	a := newAggregation()
+	a.add(desc, newLabelSet("x"), 1)
+	a.observe(histDesc, buckets, newLabelSet("x"), 0.5, 1)
+	known := a.zeroFill(nil, start, time.Hour)
+
+	b := newAggregation()
+	b.add(desc, newLabelSet("y"), 2)
+	known = b.zeroFill(known, start.Add(30*time.Minute), time.Hour)
+
+	if v, ok := b.values[seriesKey{desc, newLabelSet("x")}]; !ok || v != 0 {
+		t.Errorf("expected a zero value for x, got %v", v)
+	}
+
+	if h, ok := b.histograms[seriesKey{histDesc, newLabelSet("x")}]; !ok || h.count != 0 || len(h.upperBounds) != 1 {
+		t.Errorf("expected an empty histogram for x, got %+v", h)
+	}
+
+	// x was last seen an hour ago, and y half an hour ago.
+	c := newAggregation()
+	c.zeroFill(known, start.Add(time.Hour), time.Hour)
+
+	if len(c.values) != 1 || len(c.histograms) != 0 {
+		t.Errorf("expected only y to be filled, got %v and %v", c.values, c.histograms)
+	}
+
+	if _, ok := c.values[seriesKey{desc, newLabelSet("y")}]; !ok {
+		t.Error("expected a zero value for y")
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// errorClass classifies the errors which occur while collecting metrics, so
+// that they can be handled and counted by their cause.
+type errorClass string
+
+const (
+	// errorClassAuth is the class of errors caused by invalid credentials.
+	errorClassAuth errorClass = "auth"
+	// errorClassZoneForbidden is the class of errors caused by zones which
+	// do not exist, or which the credentials do not grant access to.
+	errorClassZoneForbidden errorClass = "zone_forbidden"
+	// errorClassRetentionDisabled is the class of errors caused by zones
+	// without log retention enabled.
+	errorClassRetentionDisabled errorClass = "retention_disabled"
+	// errorClassTimeRange is the class of errors caused by time windows
+	// which the Logpull API does not serve, such as those older than its
+	// retention or more recent than its delay.
+	errorClassTimeRange errorClass = "time_range"
+	// errorClassBadRequest is the class of other requests rejected by the
+	// API as invalid.
+	errorClassBadRequest errorClass = "bad_request"
+	// errorClassRateLimited is the class of errors caused by the rate
+	// limits of the API.
+	errorClassRateLimited errorClass = "rate_limited"
+	// errorClassServer is the class of errors which the API reports as its
+	// own, with a 5xx status.
+	errorClassServer errorClass = "server"
+	// errorClassTransport is the class of errors which prevented a
+	// response from being received at all.
+	errorClassTransport errorClass = "transport"
+	// errorClassTruncated is the class of errors caused by responses which
+	// were cut off before their end.
+	errorClassTruncated errorClass = "truncated"
+	// errorClassTimeout is the class of errors caused by pulls which did
+	// not complete in time.
+	errorClassTimeout errorClass = "timeout"
+	// errorClassDecode is the class of errors caused by responses which
+	// could not be decoded.
+	errorClassDecode errorClass = "decode"
+	// errorClassZoneResolution is the class of errors which prevented the
+	// ID of a zone from being resolved from its name.
+	errorClassZoneResolution errorClass = "zone_resolution"
+	// errorClassZoneDiscovery is the class of errors which prevented zones
+	// from being discovered.
+	errorClassZoneDiscovery errorClass = "zone_discovery"
+	// errorClassOther is the class of all other errors.
+	errorClassOther errorClass = "other"
+)
+
+// retryable reports whether errors of the class may not recur if the request
+// which caused them is retried.
+func (c errorClass) retryable() bool {
+	switch c {
+	case errorClassRateLimited, errorClassServer, errorClassTransport, errorClassTruncated:
+		return true
+	default:
+		return false
+	}
+}
+
+// apiError is a classified error from a request to the Cloudflare API. Errors
+// returned by the API are described by the status and messages of the
+// response; other errors, such as transport errors, wrap the error which
+// occurred.
+type apiError struct {
+	class errorClass
+	// status is the HTTP status of the response, or zero if no response
+	// was received.
+	status int
+	// messages holds the messages of the errors in the response, each
+	// prefixed with its error code if the response contained any.
+	messages []string
+	// retryAfter is the delay requested by the API through the
+	// Retry-After header, if any.
+	retryAfter time.Duration
+	err        error
+}
+
+func (e *apiError) Error() string {
+	if e.err != nil {
+		return fmt.Sprintf("%s: %s", e.class, e.err)
+	}
+	return fmt.Sprintf("%s: unexpected api response: %d %s: %s", e.class, e.status, http.StatusText(e.status), strings.Join(e.messages, "; "))
+}
+
+func (e *apiError) Unwrap() error {
+	return e.err
+}
+
+// newResponseError creates an apiError from a response with the given status,
+// header and body. The body is parsed as the error envelope of the Cloudflare
+// API, {"success":false,"errors":[{"code":...,"message":...}]}, or otherwise
+// taken to be a plain-text error message, as returned by the Logpull API for
+// some errors.
+func newResponseError(status int, header http.Header, body []byte) *apiError {
+	e := &apiError{
+		status:     status,
+		retryAfter: parseRetryAfter(header.Get("Retry-After"), time.Now()),
+	}
+
+	var envelope struct {
+		Errors []struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+
+	if err := json.Unmarshal(body, &envelope); err == nil && len(envelope.Errors) > 0 {
+		for _, detail := range envelope.Errors {
+			e.messages = append(e.messages, fmt.Sprintf("%d: %s", detail.Code, detail.Message))
+		}
+	} else {
+		e.messages = []string{strings.TrimSpace(string(body))}
+	}
+
+	e.class = classifyResponse(status, strings.ToLower(strings.Join(e.messages, " ")))
+
+	return e
+}
+
+// timeRangeMessages are the parts of the messages with which the Logpull API
+// rejects a start or end outside of the range of available logs.
+var timeRangeMessages = []string{"time range", "too early", "too late", "older than"}
+
+// containsAny reports whether s contains any of the given substrings.
+func containsAny(s string, substrs []string) bool {
+	for _, substr := range substrs {
+		if strings.Contains(s, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+// classifyResponse returns the class of an error response with the given
+// status and lowercased messages. The Logpull API rejects every invalid
+// request with status 400, so those are told apart by their messages.
+func classifyResponse(status int, messages string) errorClass {
+	switch {
+	case status == http.StatusUnauthorized:
+		return errorClassAuth
+	case status == http.StatusForbidden:
+		return errorClassZoneForbidden
+	case status == http.StatusTooManyRequests:
+		return errorClassRateLimited
+	case status >= 500:
+		return errorClassServer
+	case strings.Contains(messages, "retention"):
+		return errorClassRetentionDisabled
+	case containsAny(messages, timeRangeMessages):
+		return errorClassTimeRange
+	case status == http.StatusBadRequest:
+		return errorClassBadRequest
+	default:
+		return errorClassOther
+	}
+}
+
+// classifyError returns the class of an error which occurred while collecting
+// metrics. Errors caused by a pull running out of time are classified as
+// timeouts, whatever the request in progress returned.
+func classifyError(err error) errorClass {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errorClassTimeout
+	}
+
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return apiErr.class
+	}
+
+	return errorClassOther
+}
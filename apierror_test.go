@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// TestPullLogEntriesErrorClasses pulls logs from a mock Cloudflare API server
+// with invalid parameters, and checks that each error is returned as an
+// *apiError of the expected class.
+func TestPullLogEntriesErrorClasses(t *testing.T) {
+	testCases := []struct {
+		condition     string
+		apiKey        string
+		zoneID        string
+		expectedClass errorClass
+	}{
+		{"with invalid API key", "garbage", goodZoneID, errorClassAuth},
+		{"with unauthorized zone ID", goodKey, unauthorizedZoneID, errorClassZoneForbidden},
+		{"with log retention disabled for zone ID", goodKey, logRetentionDisabledZoneID, errorClassRetentionDisabled},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.condition, func(t *testing.T) {
+			ts := httptest.NewServer(mockHandlerFunc(t, mockLogpullHandler))
+			defer ts.Close()
+
+			api := newLogpullAPI(c.apiKey, goodEmail)
+			api.setAPIProperties(ts.URL, ts.Client())
+
+			_, err := api.pullLogEntries(context.Background(), c.zoneID, goodStart, goodEnd, defaultLabelFields, 1, nopLogHandler)
+
+			var apiErr *apiError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("expected an *apiError, got: %v", err)
+			}
+			if apiErr.class != c.expectedClass {
+				t.Errorf("expected class %s, got %s", c.expectedClass, apiErr.class)
+			}
+		})
+	}
+
+	ts := httptest.NewServer(mockHandlerFunc(t, mockLogpullHandler))
+	defer ts.Close()
+
+	api := newLogpullAPI(goodKey, goodEmail)
+	api.setAPIProperties(ts.URL, ts.Client())
+
+	_, err := api.pullLogEntries(context.Background(), goodZoneID, tooEarlyStart, tooEarlyEnd, defaultLabelFields, 1, nopLogHandler)
+	if class := classifyError(err); class != errorClassTimeRange {
+		t.Errorf("expected class %s for a too early time range, got %s", errorClassTimeRange, class)
+	}
+}
+
+// TestNewResponseError checks that the messages of error responses are taken
+// from the error envelope of the Cloudflare API, or from the plain-text body.
+func TestNewResponseError(t *testing.T) {
+	testCases := []struct {
+		condition        string
+		status           int
+		body             string
+		expectedClass    errorClass
+		expectedMessages []string
+	}{
+		{"with an error envelope", http.StatusUnauthorized, `{"success":false,"errors":[{"code":10000,"message":"Authentication error"}]}`, errorClassAuth, []string{"10000: Authentication error"}},
+		{"with several errors", http.StatusBadRequest, `{"success":false,"errors":[{"code":1,"message":"a"},{"code":2,"message":"b"}]}`, errorClassBadRequest, []string{"1: a", "2: b"}},
+		{"with a plain-text body", http.StatusBadRequest, "Retention is not turned on\n", errorClassRetentionDisabled, []string{"Retention is not turned on"}},
+		{"with a time range error", http.StatusBadRequest, "bad query: error parsing time: invalid time range: too late: end must be at least 1m0s ago", errorClassTimeRange, []string{"bad query: error parsing time: invalid time range: too late: end must be at least 1m0s ago"}},
+		{"with an unknown field", http.StatusBadRequest, "bad query: unknown field: EdgeStartTimestamp", errorClassBadRequest, []string{"bad query: unknown field: EdgeStartTimestamp"}},
+		{"with a JSON body without errors", http.StatusServiceUnavailable, `{"success":false}`, errorClassServer, []string{`{"success":false}`}},
+		{"when rate limited", http.StatusTooManyRequests, "", errorClassRateLimited, []string{""}},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.condition, func(t *testing.T) {
+			err := newResponseError(c.status, http.Header{}, []byte(c.body))
+			if err.class != c.expectedClass {
+				t.Errorf("expected class %s, got %s", c.expectedClass, err.class)
+			}
+			if !reflect.DeepEqual(err.messages, c.expectedMessages) {
+				t.Errorf("expected messages %q, got %q", c.expectedMessages, err.messages)
+			}
+		})
+	}
+}
+
+// TestClassifyError checks that errors are classified through any wrapping,
+// and that deadlines take precedence over the class of the request error.
+func TestClassifyError(t *testing.T) {
+	testCases := []struct {
+		condition     string
+		err           error
+		expectedClass errorClass
+	}{
+		{"with a wrapped apiError", fmt.Errorf("giving up: %w", &apiError{class: errorClassServer}), errorClassServer},
+		{"with an exceeded deadline", fmt.Errorf("waiting: %w", context.DeadlineExceeded), errorClassTimeout},
+		{"with another error", errors.New("handler: failed"), errorClassOther},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.condition, func(t *testing.T) {
+			if class := classifyError(c.err); class != c.expectedClass {
+				t.Errorf("expected class %s, got %s", c.expectedClass, class)
+			}
+		})
+	}
+}
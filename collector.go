@@ -1,122 +1,888 @@
 package main
 
 import (
+	"context"
 	"errors"
-	"strconv"
+	"fmt"
 	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	prommodel "github.com/prometheus/common/model"
 )
 
 // The Cloudflare API docs specify that 'start' must be no more than seven days
 // earlier from now, and that 'end' must be at least one minute earlier than
 // now. Thus, logPeriod must be smaller than seven days, less one minute to
-// account for the one minute offset.
+// account for the one minute offset, and less any further end offset and
+// alignment of the window.
 // https://developers.cloudflare.com/logs/logpull-api/requesting-logs#parameters
-const logPeriodRange = 7*24*time.Hour - time.Minute
+const (
+	logRetention   = 7 * 24 * time.Hour
+	minEndOffset   = time.Minute
+	logPeriodRange = logRetention - minEndOffset
+	// retentionMargin is how much later than the retention limit the
+	// earliest window of a contiguous pull starts.
+	retentionMargin = time.Minute
+)
+
+// windowMode represents the ways in which the collector can choose the time
+// window of each pull.
+type windowMode int
+
+const (
+	// windowSliding specifies that each pull covers the most recent logPeriod,
+	// and that metrics are reported as gauges describing that period alone.
+	windowSliding windowMode = iota
+	// windowContiguous specifies that each pull covers exactly the interval
+	// since the end of the previous successful pull, and that metrics are
+	// accumulated and reported as counters.
+	windowContiguous
+)
+
+// collectorConfig contains the settings of a collector.
+type collectorConfig struct {
+	logPeriod  time.Duration
+	windowMode windowMode
+	// labelFields are the Logpull fields used as labels of the HTTP
+	// responses metric. If empty, defaultLabelFields is used.
+	labelFields []string
+	// latencyBuckets are the bucket upper bounds, in seconds, of the
+	// latency histograms. If empty, defaultLatencyBuckets is used.
+	latencyBuckets []float64
+	// sizeBuckets are the bucket upper bounds, in bytes, of the request
+	// and response size histograms. If empty, the histograms are disabled.
+	sizeBuckets []float64
+	// metricFamilies are the names of the metricFamilies which are
+	// enabled. The HTTP responses metric is always enabled.
+	metricFamilies []string
+	// countryTopN, if non-zero, adds ClientCountry to the labels of the
+	// HTTP responses metric, and caps the number of distinct countries
+	// reported per zone, reporting all others as "other".
+	countryTopN int
+	// routes, if not empty, are the route rules used to add a route label
+	// to the HTTP responses metric. See parseRouteRule for their syntax.
+	routes []string
+	// filters select the log entries of every zone which are used to
+	// derive metrics.
+	filters []fieldFilter
+	// sampleRate, if non-zero, is the fraction of the log entries of every
+	// zone which are pulled, unless overridden by the zone. Metrics are
+	// scaled by its inverse, so they are estimates.
+	sampleRate float64
+	// seriesTTL, if non-zero, is how long the series of metrics derived
+	// from log entries are reported with a value of zero, in sliding
+	// mode, after the last period in which they had any log entries.
+	seriesTTL time.Duration
+	// endOffset is how long before the time of each pull its window ends,
+	// so that Cloudflare has received all of the logs of the window. If
+	// zero, minEndOffset is used.
+	endOffset time.Duration
+	// alignWindows truncates the end of each window to a whole minute, so
+	// that the windows of consecutive pulls do not depend on when the
+	// collector was started.
+	alignWindows bool
+	// timestamps reports the metrics derived from log entries with the
+	// end of the window they describe as their timestamp.
+	timestamps bool
+	// minuteBuckets aggregates the log entries of each minute of a window
+	// separately, by their EdgeStartTimestamp, and reports each minute
+	// with its own timestamp. It requires sliding mode and aligned windows.
+	minuteBuckets bool
+}
+
+// zone holds the settings of a single zone from which logs are pulled.
+type zone struct {
+	// id is empty if the zone was configured by name, and its ID has not
+	// been resolved yet. Logs are only pulled from resolved zones.
+	id   string
+	name string
+	// filters select the log entries of the zone which are used to derive
+	// metrics, in addition to the filters of the collector.
+	filters []fieldFilter
+	// sampleRate, if non-zero, overrides the sample rate of the collector
+	// for the zone.
+	sampleRate float64
+}
 
 type collector struct {
-	api          *logpullAPI
-	zoneIDs      []string
-	logPeriod    time.Duration
-	responseDesc *prometheus.Desc
-	errorCounter prometheus.Counter
-	errorHandler func(error)
+	api            *logpullAPI
+	filters        []fieldFilter
+	sampleRate     float64
+	seriesTTL      time.Duration
+	endOffset      time.Duration
+	alignWindows   bool
+	timestamps     bool
+	minuteBuckets  bool
+	logPeriod      time.Duration
+	windowMode     windowMode
+	metrics        *logMetrics
+	fields         []string
+	ageDesc        *prometheus.Desc
+	sampleRateDesc *prometheus.Desc
+	resolvedDesc   *prometheus.Desc
+	infoDesc       *prometheus.Desc
+	healthDescs    healthDescs
+	errorCounter   *prometheus.CounterVec
+	errorHandler   func(error)
+	// now returns the time from which the windows of pulls are chosen. It
+	// is time.Now, unless replaced by tests.
+	now func() time.Time
+
+	// ready is closed once the first pull has completed.
+	ready     chan struct{}
+	readyOnce sync.Once
+
+	// mu guards zones, which may be replaced by setZones at runtime,
+	// snapshots and health.
+	mu        sync.RWMutex
+	zones     []zone
+	snapshots map[string]*snapshot
+	health    map[string]*zoneHealth
+}
+
+// healthDescs describes the metrics which report the health of the pulls of
+// each zone.
+type healthDescs struct {
+	success     *prometheus.Desc
+	lastSuccess *prometheus.Desc
+	duration    *prometheus.Desc
+	entries     *prometheus.Desc
+	bytes       *prometheus.Desc
 }
 
-// newCollector creates a new Logpull collector. Returns an error if any
+// zoneHealth holds the outcome of the pulls of a single zone. Unlike a
+// snapshot, it is updated by every pull, whether or not it succeeds.
+type zoneHealth struct {
+	success     bool
+	lastSuccess time.Time
+	duration    time.Duration
+	// stats holds the total work done by every pull of the zone.
+	stats pullStats
+}
+
+// snapshot holds the aggregated result of pulling a single zone. In sliding
+// mode, it covers only the most recent pull; in contiguous mode, it covers
+// every pull since the collector was created. It is replaced, never modified,
+// once stored in the collector.
+type snapshot struct {
+	metrics   *aggregation
+	countries *countryCap
+	pulledAt  time.Time
+	end       time.Time
+	// sampleRate is the effective sample rate of the most recent pull.
+	sampleRate float64
+	// known holds the series which are zero-filled by the next pull in
+	// sliding mode, if the collector has a seriesTTL.
+	known map[seriesKey]knownSeries
+	// buckets, if the collector has minuteBuckets, holds the metrics of
+	// each minute of the window, oldest first, in place of metrics.
+	buckets []*aggregation
+	// tick, if the collector has minuteBuckets, is the time at which the
+	// pull began. The minutes of the window are replayed from a minute
+	// after it, whenever the pull completes.
+	tick time.Time
+	// carry, if the collector has minuteBuckets, holds the metrics of the
+	// last minute of the previous window, which ended at carryEnd. It is
+	// replayed until the first minute of this window.
+	carry    *aggregation
+	carryEnd time.Time
+}
+
+// newCollector creates a new Logpull collector. The given zones may be empty,
+// as zones can be added later through setZones. Returns an error if any
 // parameters are invalid.
-func newCollector(api *logpullAPI, zoneIDs []string, logPeriod time.Duration, errorHandler func(error)) (*collector, error) {
+func newCollector(api *logpullAPI, zones []zone, cfg collectorConfig, errorHandler func(error)) (*collector, error) {
 	if api == nil {
 		return nil, errors.New("invalid parameter: api must not be nil")
 	}
 
-	if len(zoneIDs) == 0 {
-		return nil, errors.New("invalid parameter: zoneIDs must not be empty")
+	if cfg.endOffset == 0 {
+		cfg.endOffset = minEndOffset
+	}
+
+	if cfg.endOffset < minEndOffset {
+		return nil, errors.New("invalid parameter: endOffset must be at least one minute")
 	}
 
-	if logPeriod >= logPeriodRange {
+	lookback := cfg.logPeriod + cfg.endOffset - minEndOffset + alignmentMargin(cfg.alignWindows)
+	if cfg.logPeriod <= 0 || lookback >= logPeriodRange {
 		return nil, errors.New("invalid parameter: logPeriod out of acceptable range")
 	}
 
-	responseDesc := prometheus.NewDesc(
-		"cloudflare_logs_http_responses",
-		"Cloudflare HTTP responses, obtained via Logpull API",
-		[]string{
-			"client_request_host",
-			"edge_response_status",
-			"origin_response_status",
-		},
-		prometheus.Labels{
-			"period": prommodel.Duration(logPeriod).String(),
-		},
+	if cfg.alignWindows && cfg.logPeriod%time.Minute != 0 {
+		return nil, errors.New("invalid parameter: logPeriod must be a whole number of minutes when windows are aligned")
+	}
+
+	if cfg.minuteBuckets && (cfg.windowMode != windowSliding || !cfg.alignWindows) {
+		return nil, errors.New("invalid parameter: minuteBuckets requires sliding windowMode and aligned windows")
+	}
+
+	if cfg.minuteBuckets && cfg.logPeriod <= time.Minute {
+		return nil, errors.New("invalid parameter: minuteBuckets requires a logPeriod longer than one minute")
+	}
+
+	if !validSampleRate(cfg.sampleRate) {
+		return nil, errors.New("invalid parameter: sampleRate must be greater than 0 and at most 1")
+	}
+
+	if cfg.seriesTTL < 0 {
+		return nil, errors.New("invalid parameter: seriesTTL must not be negative")
+	}
+
+	metrics, err := newLogMetrics(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := metrics.fields()
+	if cfg.minuteBuckets {
+		fields = append(fields, "EdgeStartTimestamp")
+	}
+
+	ageDesc := prometheus.NewDesc(
+		"cloudflare_logs_snapshot_age_seconds",
+		"Seconds since the metrics of a zone were last pulled from the Logpull API",
+		[]string{"zone_id"},
+		nil,
 	)
 
-	errorCounter := prometheus.NewCounter(prometheus.CounterOpts{
+	sampleRateDesc := prometheus.NewDesc(
+		"cloudflare_logs_sample_rate",
+		"The fraction of the log entries of a zone which are pulled; metrics of zones with a sample rate below 1 are estimates",
+		[]string{"zone_id"},
+		nil,
+	)
+
+	resolvedDesc := prometheus.NewDesc(
+		"cloudflare_logs_zone_resolved",
+		"Whether the ID of a zone configured by name has been resolved, so that its logs are pulled",
+		[]string{"zone_name"},
+		nil,
+	)
+
+	infoDesc := prometheus.NewDesc(
+		"cloudflare_logs_zone_info",
+		"The ID and name of every zone whose logs are pulled, with a value of 1; the name is empty for zones configured by ID",
+		zoneLabels,
+		nil,
+	)
+
+	healthDescs := healthDescs{
+		success: prometheus.NewDesc(
+			"cloudflare_logs_pull_success",
+			"Whether the most recent pull of a zone from the Logpull API succeeded",
+			[]string{"zone_id"},
+			nil,
+		),
+		lastSuccess: prometheus.NewDesc(
+			"cloudflare_logs_last_success_timestamp_seconds",
+			"Unix time at which the most recent successful pull of a zone from the Logpull API completed",
+			[]string{"zone_id"},
+			nil,
+		),
+		duration: prometheus.NewDesc(
+			"cloudflare_logs_pull_duration_seconds",
+			"Duration of the most recent pull of a zone from the Logpull API, including retries",
+			[]string{"zone_id"},
+			nil,
+		),
+		entries: prometheus.NewDesc(
+			"cloudflare_logs_entries_processed_total",
+			"The number of log entries of a zone processed from Logpull API responses",
+			[]string{"zone_id"},
+			nil,
+		),
+		bytes: prometheus.NewDesc(
+			"cloudflare_logs_bytes_read_total",
+			"The number of bytes of a zone read from Logpull API responses",
+			[]string{"zone_id"},
+			nil,
+		),
+	}
+
+	errorCounter := prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "cloudflare_logs_errors_total",
-		Help: "The number of errors that have occurred while collecting metrics",
-	})
+		Help: "The number of errors that have occurred while collecting metrics, by zone and class",
+	}, []string{"zone_id", "class"})
 
 	return &collector{
-		api,
-		zoneIDs,
-		logPeriod,
-		responseDesc,
-		errorCounter,
-		errorHandler,
+		api:            api,
+		zones:          zones,
+		filters:        cfg.filters,
+		sampleRate:     cfg.sampleRate,
+		seriesTTL:      cfg.seriesTTL,
+		endOffset:      cfg.endOffset,
+		alignWindows:   cfg.alignWindows,
+		timestamps:     cfg.timestamps,
+		minuteBuckets:  cfg.minuteBuckets,
+		logPeriod:      cfg.logPeriod,
+		windowMode:     cfg.windowMode,
+		metrics:        metrics,
+		fields:         fields,
+		ageDesc:        ageDesc,
+		sampleRateDesc: sampleRateDesc,
+		resolvedDesc:   resolvedDesc,
+		infoDesc:       infoDesc,
+		healthDescs:    healthDescs,
+		errorCounter:   errorCounter,
+		errorHandler:   errorHandler,
+		now:            time.Now,
+		snapshots:      make(map[string]*snapshot),
+		health:         make(map[string]*zoneHealth),
+		ready:          make(chan struct{}),
 	}, nil
 }
 
+// run pulls logs for every zone once immediately, and then once every
+// logPeriod, until ctx is done, which also cancels the pull in progress.
+// Pulls are never triggered by scrapes, so the Logpull API usage of the
+// exporter does not depend on how often, or by how many Prometheus servers,
+// it is scraped.
+func (c *collector) run(ctx context.Context) {
+	ticker := time.NewTicker(c.logPeriod)
+	defer ticker.Stop()
+
+	for {
+		c.pull(ctx)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// pull concurrently pulls logs for every zone, and replaces the stored
+// snapshot of each zone with the result, and updates its health. It returns
+// once all zones have been pulled, or ctx is done, in which case the
+// snapshots and health are left as they were.
+// A pull which takes longer than logPeriod is cancelled, so that a stalled
+// response cannot hold up the next pull.
+func (c *collector) pull(ctx context.Context) {
+	pullCtx, cancel := context.WithTimeout(ctx, c.logPeriod)
+	defer cancel()
+
+	tick := c.now()
+	end := c.windowEnd(tick)
+
+	c.mu.RLock()
+	zones := c.zones
+	c.mu.RUnlock()
+
+	var wg sync.WaitGroup
+
+	for _, z := range zones {
+		if z.id == "" {
+			continue
+		}
+
+		wg.Add(1)
+		go func(z zone) {
+			defer wg.Done()
+
+			started := time.Now()
+
+			var snap *snapshot
+			var stats pullStats
+			var err error
+			switch c.windowMode {
+			case windowSliding:
+				snap, stats, err = c.pullSliding(pullCtx, z, tick, end)
+			case windowContiguous:
+				snap, stats, err = c.pullContiguous(pullCtx, z, end)
+			}
+
+			if ctx.Err() != nil {
+				return
+			}
+
+			if err != nil {
+				c.reportError(z.id, err)
+			}
+
+			c.mu.Lock()
+			defer c.mu.Unlock()
+
+			// The zone may have been removed while it was being
+			// pulled, or the collector stopped and its snapshots
+			// handed over, in which case its snapshot is discarded.
+			if ctx.Err() != nil || !c.hasZone(z.id) {
+				return
+			}
+
+			if snap != nil {
+				c.snapshots[z.id] = snap
+			}
+
+			health := c.health[z.id]
+			if health == nil {
+				health = &zoneHealth{}
+				c.health[z.id] = health
+			}
+
+			health.success = err == nil
+			health.duration = time.Since(started)
+			health.stats.add(stats)
+			if err == nil {
+				health.lastSuccess = time.Now()
+			}
+		}(z)
+	}
+
+	wg.Wait()
+	c.readyOnce.Do(func() { close(c.ready) })
+}
+
+// windowEnd returns the end of the window of a pull at the given time, which
+// is endOffset earlier, and truncated to a whole minute if windows are
+// aligned.
+func (c *collector) windowEnd(now time.Time) time.Time {
+	end := now.Add(-1 * c.endOffset)
+	if c.alignWindows {
+		end = end.Truncate(time.Minute)
+	}
+	return end
+}
+
+// alignmentMargin returns how much earlier than endOffset the end of a window
+// may be, when windows are aligned or not.
+func alignmentMargin(alignWindows bool) time.Duration {
+	if alignWindows {
+		return time.Minute
+	}
+	return 0
+}
+
+// waitReady blocks until the first pull of the collector has completed, or
+// ctx is done.
+func (c *collector) waitReady(ctx context.Context) {
+	select {
+	case <-c.ready:
+	case <-ctx.Done():
+	}
+}
+
+// setZones replaces the zones from which logs are pulled, starting with the
+// next pull. The snapshots and health of removed zones are discarded, so
+// their metrics are no longer reported. Zones which are kept retain them.
+func (c *collector) setZones(zones []zone) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.zones = zones
+
+	for id := range c.snapshots {
+		if !c.hasZone(id) {
+			delete(c.snapshots, id)
+		}
+	}
+
+	for id := range c.health {
+		if !c.hasZone(id) {
+			delete(c.health, id)
+		}
+	}
+}
+
+// inherit hands the snapshots of old, a contiguous mode collector which c
+// replaces, over to c, so that the windows of c follow on from those already
+// pulled by old, rather than pulling them again and counting them twice. If
+// both have the same metrics, their counters are carried over too; otherwise,
+// the counters of c start from zero. old must have been stopped, so that it
+// stores no further snapshots, and c must not have been started.
+func (c *collector) inherit(old *collector) {
+	if c.windowMode != windowContiguous || old.windowMode != windowContiguous {
+		return
+	}
+
+	descs := c.metrics.translation(old.metrics)
+
+	old.mu.RLock()
+	defer old.mu.RUnlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for id, snap := range old.snapshots {
+		if !c.hasZone(id) {
+			continue
+		}
+
+		next := &snapshot{
+			metrics:    newAggregation(),
+			countries:  newCountryCap(),
+			pulledAt:   snap.pulledAt,
+			end:        snap.end,
+			sampleRate: snap.sampleRate,
+		}
+		if descs != nil {
+			next.metrics = snap.metrics.translate(descs)
+			next.countries = snap.countries.clone()
+		}
+		c.snapshots[id] = next
+	}
+}
+
+// hasZone reports whether logs are pulled from the zone with the given ID.
+// c.mu must be held by the caller.
+func (c *collector) hasZone(id string) bool {
+	for _, z := range c.zones {
+		if z.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// validSampleRate reports whether the given sample rate is either zero, which
+// disables sampling, or greater than 0 and at most 1.
+func validSampleRate(sampleRate float64) bool {
+	return sampleRate >= 0 && sampleRate <= 1
+}
+
+// zoneSampleRate returns the fraction of the log entries of the given zone
+// which are pulled.
+func (c *collector) zoneSampleRate(z zone) float64 {
+	if z.sampleRate > 0 {
+		return z.sampleRate
+	}
+	if c.sampleRate > 0 {
+		return c.sampleRate
+	}
+	return 1
+}
+
+// pullWindow pulls the logs of a zone between start and end, and adds the
+// metrics derived from the log entries selected by the filters of the
+// collector and the zone to the given buckets. The window is split evenly
+// between the buckets, and each log entry is added to the bucket of its
+// EdgeStartTimestamp; entries without one, or outside of the window, are
+// added to the nearest bucket.
+func (c *collector) pullWindow(ctx context.Context, z zone, start, end time.Time, buckets []*aggregation) (pullStats, error) {
+	filters := append(append([]fieldFilter(nil), c.filters...), z.filters...)
+
+	fields := append([]string(nil), c.fields...)
+	for _, f := range filters {
+		fields = append(fields, f.field)
+	}
+
+	sampleRate := c.zoneSampleRate(z)
+	width := end.Sub(start) / time.Duration(len(buckets))
+
+	return c.api.pullLogEntries(ctx, z.id, start, end, dedupeFields(fields), sampleRate, func(entry logEntry) error {
+		for _, f := range filters {
+			if !f.selects(entry) {
+				return nil
+			}
+		}
+
+		i := 0
+		if ns, ok := entry.number("EdgeStartTimestamp"); ok && len(buckets) > 1 {
+			i = int(time.Unix(0, int64(ns)).Sub(start) / width)
+			if i < 0 {
+				i = 0
+			} else if i >= len(buckets) {
+				i = len(buckets) - 1
+			}
+		}
+
+		c.metrics.observe(buckets[i], entry, 1/sampleRate)
+		return nil
+	})
+}
+
+// dedupeFields returns the given fields with any duplicates removed.
+func dedupeFields(fields []string) []string {
+	seen := make(map[string]bool, len(fields))
+	deduped := make([]string, 0, len(fields))
+	for _, field := range fields {
+		if !seen[field] {
+			seen[field] = true
+			deduped = append(deduped, field)
+		}
+	}
+	return deduped
+}
+
+// pullSliding pulls the logPeriod worth of logs of a zone ending at end. If
+// the pull fails, the log entries pulled before the failure would report a
+// fraction of the traffic of the window as if it were all of it, so they are
+// discarded: the returned snapshot holds no metrics, and keeps the pull time
+// of the previous snapshot, or is nil if there is none. If the collector has
+// a seriesTTL, series of previous pulls which have no log entries in the
+// window are reported as zero. If the collector has minuteBuckets, each
+// minute of the window is aggregated into its own bucket, to be replayed from
+// the given tick, at which the pull began.
+func (c *collector) pullSliding(ctx context.Context, z zone, tick, end time.Time) (*snapshot, pullStats, error) {
+	countries := newCountryCap()
+
+	buckets := []*aggregation{newAggregation()}
+	if c.minuteBuckets {
+		buckets = make([]*aggregation, c.logPeriod/time.Minute)
+		for i := range buckets {
+			buckets[i] = newAggregation()
+		}
+	}
+
+	c.mu.RLock()
+	prev := c.snapshots[z.id]
+	c.mu.RUnlock()
+
+	start := end.Add(-1 * c.logPeriod)
+
+	stats, err := c.pullWindow(ctx, z, start, end, buckets)
+	if err != nil {
+		if prev == nil {
+			return nil, stats, err
+		}
+
+		return &snapshot{
+			metrics:    newAggregation(),
+			countries:  countries,
+			pulledAt:   prev.pulledAt,
+			end:        prev.end,
+			sampleRate: prev.sampleRate,
+			known:      prev.known,
+		}, stats, err
+	}
+
+	var known map[seriesKey]knownSeries
+	if prev != nil {
+		known = prev.known
+	}
+
+	width := c.logPeriod / time.Duration(len(buckets))
+	for i, bucket := range buckets {
+		c.metrics.capCountries(bucket, countries)
+		if c.seriesTTL > 0 {
+			known = bucket.zeroFill(known, start.Add(time.Duration(i+1)*width), c.seriesTTL)
+		}
+	}
+
+	snap := &snapshot{
+		metrics:    buckets[0],
+		countries:  countries,
+		pulledAt:   c.now(),
+		end:        end,
+		sampleRate: c.zoneSampleRate(z),
+		known:      known,
+	}
+
+	if c.minuteBuckets {
+		snap.metrics = newAggregation()
+		snap.buckets = buckets
+		snap.tick = tick
+		if prev != nil && len(prev.buckets) > 0 {
+			snap.carry = prev.buckets[len(prev.buckets)-1]
+			snap.carryEnd = prev.end
+		}
+	}
+
+	return snap, stats, err
+}
+
+// pullContiguous pulls the logs of a zone from the end of its previous
+// successful pull up to end, in windows no longer than logPeriod, and adds
+// them to the totals of the previous snapshot. A window is only added once it
+// has been pulled in full, and a failed window is retried by the next pull,
+// so that every log entry is counted exactly once. The error of the failed
+// window, if any, is returned along with the snapshot.
+func (c *collector) pullContiguous(ctx context.Context, z zone, end time.Time) (*snapshot, pullStats, error) {
+	c.mu.RLock()
+	prev := c.snapshots[z.id]
+	c.mu.RUnlock()
+
+	metrics := newAggregation()
+	countries := newCountryCap()
+	start := end.Add(-1 * c.logPeriod)
+
+	if prev != nil {
+		metrics = prev.metrics.clone()
+		countries = prev.countries.clone()
+		start = prev.end
+	}
+
+	// Logs older than the Logpull API's retention can no longer be
+	// pulled, so there is no point in trying to catch up on them. The
+	// earliest start keeps a margin from the retention limit, as time
+	// passes before the request is made and its start is rounded down to
+	// a whole second. It is rounded up to a whole second, or to a whole
+	// minute when windows are aligned, so that the following windows stay
+	// aligned.
+	earliest := end.Add(-1*(logRetention-c.endOffset-alignmentMargin(c.alignWindows)) + retentionMargin)
+	if c.alignWindows {
+		earliest = earliest.Add(time.Minute - 1).Truncate(time.Minute)
+	} else {
+		earliest = earliest.Add(time.Second - 1).Truncate(time.Second)
+	}
+	if start.Before(earliest) {
+		start = earliest
+	}
+
+	var stats pullStats
+	var err error
+
+	for start.Before(end) {
+		windowEnd := start.Add(c.logPeriod)
+		if windowEnd.After(end) {
+			windowEnd = end
+		}
+
+		window := newAggregation()
+
+		var windowStats pullStats
+		windowStats, err = c.pullWindow(ctx, z, start, windowEnd, []*aggregation{window})
+		stats.add(windowStats)
+		if err != nil {
+			break
+		}
+
+		c.metrics.capCountries(window, countries)
+		metrics.merge(window)
+
+		start = windowEnd
+	}
+
+	if prev != nil && start.Equal(prev.end) {
+		return prev, stats, err
+	}
+
+	return &snapshot{
+		metrics:    metrics,
+		countries:  countries,
+		pulledAt:   c.now(),
+		end:        start,
+		sampleRate: c.zoneSampleRate(z),
+	}, stats, err
+}
+
+// reportError counts the given error of the zone with the given ID by its
+// class, and passes it to the error handler. Errors which do not concern a
+// single zone are reported with an empty zoneID. Errors caused by
+// cancellation, when the collector is stopped, are ignored.
+func (c *collector) reportError(zoneID string, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	c.errorCounter.WithLabelValues(zoneID, string(classifyError(err))).Inc()
+
+	if zoneID != "" {
+		err = fmt.Errorf("zone %s: %w", zoneID, err)
+	}
+	c.errorHandler(err)
+}
+
 // Describe is a required method of the prometheus.Collector interface. It is
 // used to validate that there are no metric collisions when the collector is
 // registered.
 func (c *collector) Describe(ch chan<- *prometheus.Desc) {
-	ch <- c.responseDesc
+	c.metrics.describe(ch)
+	ch <- c.ageDesc
+	ch <- c.sampleRateDesc
+	ch <- c.resolvedDesc
+	ch <- c.infoDesc
+	ch <- c.healthDescs.success
+	ch <- c.healthDescs.lastSuccess
+	ch <- c.healthDescs.duration
+	ch <- c.healthDescs.entries
+	ch <- c.healthDescs.bytes
+	c.api.limiter.describe(ch)
 	c.errorCounter.Describe(ch)
 }
 
 // Collect is a required method of the prometheus.Collector interface. It is
 // called by the Prometheus registry whenever a new set of metrics are to be
-// collected.
+// collected. It only ever reports the snapshots stored by pull, and never
+// calls the Logpull API itself.
 func (c *collector) Collect(ch chan<- prometheus.Metric) {
-	// The Cloudflare API docs specify that 'end' must be at least one
-	// minute earlier than now.
-	// https://developers.cloudflare.com/logs/logpull-api/requesting-logs#parameters,
-	end := time.Now().Add(-1 * time.Minute)
-	start := end.Add(-1 * c.logPeriod)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 
-	var wg sync.WaitGroup
-	defer wg.Wait()
+	now := c.now()
 
-	for _, zoneID := range c.zoneIDs {
-		wg.Add(1)
-		go func(zoneID string) {
-			defer wg.Done()
+	names := make(map[string]string, len(c.zones))
+	for _, z := range c.zones {
+		if z.id != "" {
+			names[z.id] = z.name
+			ch <- prometheus.MustNewConstMetric(c.infoDesc, prometheus.GaugeValue, 1, z.id, z.name)
+		}
+	}
 
-			responses := make(map[logEntry]float64)
+	for zoneID, snap := range c.snapshots {
+		metrics, timestamp := snap.metrics, time.Time{}
+		if c.timestamps {
+			timestamp = snap.end
+		}
 
-			if err := c.api.pullLogEntries(zoneID, start, end, func(entry logEntry) error {
-				responses[entry]++
-				return nil
-			}); err != nil {
-				c.errorCounter.Inc()
-				c.errorHandler(err)
+		// A registry accepts a single sample of each series per
+		// scrape, so the minutes of a window are replayed one after
+		// another, each with the timestamp of the end of its minute.
+		// They follow the ticks of the pulls, a minute behind, rather
+		// than the time at which each pull completed, so that every
+		// minute is replayed for a whole minute, however long pulls
+		// take, as long as it is less than a minute. Until the first
+		// minute of a window is due, the last one of the previous
+		// window is replayed in its place.
+		if n := len(snap.buckets); n > 0 {
+			i := int(now.Sub(snap.tick)/time.Minute) - 1
+			if i >= n {
+				i = n - 1
 			}
-
-			for entry, count := range responses {
-				ch <- prometheus.MustNewConstMetric(
-					c.responseDesc,
-					prometheus.GaugeValue,
-					count,
-					entry.ClientRequestHost,
-					strconv.Itoa(entry.EdgeResponseStatus),
-					strconv.Itoa(entry.OriginResponseStatus),
-				)
+			if i < 0 && snap.carry != nil {
+				metrics, timestamp = snap.carry, snap.carryEnd
+			} else {
+				if i < 0 {
+					i = 0
+				}
+				metrics = snap.buckets[i]
+				timestamp = snap.end.Add(-time.Duration(n-1-i) * time.Minute)
 			}
+		}
 
-			c.errorCounter.Collect(ch)
-		}(zoneID)
+		metrics.collect(ch, c.metrics.valueType, timestamp, zoneID, names[zoneID])
+
+		ch <- prometheus.MustNewConstMetric(
+			c.ageDesc,
+			prometheus.GaugeValue,
+			now.Sub(snap.pulledAt).Seconds(),
+			zoneID,
+		)
+
+		ch <- prometheus.MustNewConstMetric(c.sampleRateDesc, prometheus.GaugeValue, snap.sampleRate, zoneID)
+	}
+
+	for zoneID, health := range c.health {
+		success := 0.0
+		if health.success {
+			success = 1
+		}
+
+		ch <- prometheus.MustNewConstMetric(c.healthDescs.success, prometheus.GaugeValue, success, zoneID)
+		ch <- prometheus.MustNewConstMetric(c.healthDescs.duration, prometheus.GaugeValue, health.duration.Seconds(), zoneID)
+		ch <- prometheus.MustNewConstMetric(c.healthDescs.entries, prometheus.CounterValue, float64(health.stats.entries), zoneID)
+		ch <- prometheus.MustNewConstMetric(c.healthDescs.bytes, prometheus.CounterValue, float64(health.stats.bytes), zoneID)
+
+		// A zone which has never been pulled successfully has no
+		// meaningful last success time, so none is reported.
+		if !health.lastSuccess.IsZero() {
+			ch <- prometheus.MustNewConstMetric(c.healthDescs.lastSuccess, prometheus.GaugeValue, float64(health.lastSuccess.UnixNano())/1e9, zoneID)
+		}
 	}
+
+	for _, z := range c.zones {
+		if z.name == "" {
+			continue
+		}
+
+		resolved := 0.0
+		if z.id != "" {
+			resolved = 1
+		}
+
+		ch <- prometheus.MustNewConstMetric(c.resolvedDesc, prometheus.GaugeValue, resolved, z.name)
+	}
+
+	c.api.limiter.collect(ch)
+	c.errorCounter.Collect(ch)
 }
@@ -1,12 +1,19 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"path"
+	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
@@ -14,7 +21,7 @@ import (
 // `cloudflare_logs_http_responses` metrics.
 func TestCollectorHTTPResponses(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		jsonBody := []byte(`{"ClientRequestHost": "example.org", "EdgeResponseStatus": 200, "OriginResponseStatus": 200}`)
+		jsonBody := []byte(`{"ClientRequestHost": "example.org", "EdgeResponseStatus": 200, "OriginResponseStatus": 200}` + "\n")
 		if _, err := w.Write(jsonBody); err != nil {
 			t.Errorf("unexpected error: %s", err)
 		}
@@ -24,17 +31,19 @@ func TestCollectorHTTPResponses(t *testing.T) {
 	api := newLogpullAPI("", "")
 	api.setAPIProperties(ts.URL, ts.Client())
 
-	c, err := newCollector(api, []string{""}, time.Minute, func(err error) {
+	c, err := newCollector(api, []zone{{id: "zone"}}, collectorConfig{logPeriod: time.Minute}, func(err error) {
 		t.Errorf("unexpected error: %s", err)
 	})
 	if err != nil {
 		t.Errorf("unexpected error: %s", err)
 	}
 
+	c.pull(context.Background())
+
 	expected := strings.NewReader(`
 		# HELP cloudflare_logs_http_responses Cloudflare HTTP responses, obtained via Logpull API
 		# TYPE cloudflare_logs_http_responses gauge
-		cloudflare_logs_http_responses{client_request_host="example.org",edge_response_status="200",origin_response_status="200",period="1m"} 1
+		cloudflare_logs_http_responses{client_request_host="example.org",edge_response_status="200",origin_response_status="200",period="1m",zone_id="zone",zone_name=""} 1
 	`)
 
 	if err := testutil.CollectAndCompare(c, expected, "cloudflare_logs_http_responses"); err != nil {
@@ -56,19 +65,995 @@ func TestCollectorErrors(t *testing.T) {
 
 	api := newLogpullAPI("", "")
 	api.setAPIProperties(ts.URL, ts.Client())
+	api.retryPolicy = retryPolicy{}
 
-	c, err := newCollector(api, []string{""}, time.Minute, func(error) {})
+	c, err := newCollector(api, []zone{{id: "zone"}}, collectorConfig{logPeriod: time.Minute}, func(error) {})
 	if err != nil {
 		t.Errorf("unexpected error: %s", err)
 	}
 
+	c.pull(context.Background())
+
 	expected := strings.NewReader(`
-		# HELP cloudflare_logs_errors_total The number of errors that have occurred while collecting metrics
+		# HELP cloudflare_logs_errors_total The number of errors that have occurred while collecting metrics, by zone and class
 		# TYPE cloudflare_logs_errors_total counter
-		cloudflare_logs_errors_total 1
+		cloudflare_logs_errors_total{class="server",zone_id="zone"} 1
 	`)
 
 	if err := testutil.CollectAndCompare(c, expected, "cloudflare_logs_errors_total"); err != nil {
 		t.Error(err)
 	}
 }
+
+// TestCollectorHealth checks that the health of the pulls of each zone is
+// reported once per zone, whether or not they succeed.
+func TestCollectorHealth(t *testing.T) {
+	jsonBody := "{\"ClientRequestHost\": \"example.org\"}\n{\"ClientRequestHost\": \"example.org\"}\n"
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if path.Base(path.Dir(path.Dir(r.URL.Path))) == "bad" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if _, err := w.Write([]byte(jsonBody)); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}))
+	defer ts.Close()
+
+	api := newLogpullAPI("", "")
+	api.setAPIProperties(ts.URL, ts.Client())
+
+	c, err := newCollector(api, []zone{{id: "good"}, {id: "bad"}}, collectorConfig{logPeriod: time.Minute}, func(error) {})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	c.pull(context.Background())
+	c.pull(context.Background())
+
+	expected := fmt.Sprintf(`
+		# HELP cloudflare_logs_bytes_read_total The number of bytes of a zone read from Logpull API responses
+		# TYPE cloudflare_logs_bytes_read_total counter
+		cloudflare_logs_bytes_read_total{zone_id="bad"} 0
+		cloudflare_logs_bytes_read_total{zone_id="good"} %d
+		# HELP cloudflare_logs_entries_processed_total The number of log entries of a zone processed from Logpull API responses
+		# TYPE cloudflare_logs_entries_processed_total counter
+		cloudflare_logs_entries_processed_total{zone_id="bad"} 0
+		cloudflare_logs_entries_processed_total{zone_id="good"} 4
+		# HELP cloudflare_logs_pull_success Whether the most recent pull of a zone from the Logpull API succeeded
+		# TYPE cloudflare_logs_pull_success gauge
+		cloudflare_logs_pull_success{zone_id="bad"} 0
+		cloudflare_logs_pull_success{zone_id="good"} 1
+	`, 2*len(jsonBody))
+
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected), "cloudflare_logs_bytes_read_total", "cloudflare_logs_entries_processed_total", "cloudflare_logs_pull_success"); err != nil {
+		t.Error(err)
+	}
+
+	// Only the zone which was pulled successfully has a last success time.
+	if n := testutil.CollectAndCount(c, "cloudflare_logs_last_success_timestamp_seconds"); n != 1 {
+		t.Errorf("expected 1 last success timestamp, got %d", n)
+	}
+
+	if n := testutil.CollectAndCount(c, "cloudflare_logs_pull_duration_seconds"); n != 2 {
+		t.Errorf("expected 2 pull durations, got %d", n)
+	}
+}
+
+// TestCollectorZoneLabels checks that zones logging requests to the same host
+// are reported as separate series, labelled with the ID and name of each
+// zone, and that the zone info metric is reported for every resolved zone.
+func TestCollectorZoneLabels(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jsonBody := []byte(`{"ClientRequestHost": "example.org", "EdgeResponseStatus": 200, "OriginResponseStatus": 200}` + "\n")
+		if _, err := w.Write(jsonBody); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}))
+	defer ts.Close()
+
+	api := newLogpullAPI("", "")
+	api.setAPIProperties(ts.URL, ts.Client())
+
+	zones := []zone{{id: "a", name: "a.example.org"}, {id: "b"}, {name: "c.example.org"}}
+	c, err := newCollector(api, zones, collectorConfig{logPeriod: time.Minute}, func(err error) {
+		t.Errorf("unexpected error: %s", err)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	c.pull(context.Background())
+
+	expected := `
+		# HELP cloudflare_logs_http_responses Cloudflare HTTP responses, obtained via Logpull API
+		# TYPE cloudflare_logs_http_responses gauge
+		cloudflare_logs_http_responses{client_request_host="example.org",edge_response_status="200",origin_response_status="200",period="1m",zone_id="a",zone_name="a.example.org"} 1
+		cloudflare_logs_http_responses{client_request_host="example.org",edge_response_status="200",origin_response_status="200",period="1m",zone_id="b",zone_name=""} 1
+		# HELP cloudflare_logs_zone_info The ID and name of every zone whose logs are pulled, with a value of 1; the name is empty for zones configured by ID
+		# TYPE cloudflare_logs_zone_info gauge
+		cloudflare_logs_zone_info{zone_id="a",zone_name="a.example.org"} 1
+		cloudflare_logs_zone_info{zone_id="b",zone_name=""} 1
+	`
+
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected), "cloudflare_logs_http_responses", "cloudflare_logs_zone_info"); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestCollectorDiscardsPartialWindow checks that in sliding mode, the log
+// entries of a pull which fails part way through are not reported, and that
+// the snapshot age keeps counting from the last complete pull.
+func TestCollectorDiscardsPartialWindow(t *testing.T) {
+	var truncate int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jsonBody := `{"ClientRequestHost": "example.org", "EdgeResponseStatus": 200, "OriginResponseStatus": 200}` + "\n"
+		if atomic.LoadInt32(&truncate) == 1 {
+			jsonBody += `{"ClientRequestHost": "exa`
+		}
+		if _, err := w.Write([]byte(jsonBody)); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}))
+	defer ts.Close()
+
+	api := newLogpullAPI("", "")
+	api.setAPIProperties(ts.URL, ts.Client())
+
+	var errs int32
+	c, err := newCollector(api, []zone{{id: "zone"}}, collectorConfig{logPeriod: time.Minute}, func(error) {
+		atomic.AddInt32(&errs, 1)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	c.pull(context.Background())
+
+	if n := testutil.CollectAndCount(c, "cloudflare_logs_http_responses"); n != 1 {
+		t.Fatalf("expected 1 response series after a complete pull, got %d", n)
+	}
+
+	c.mu.RLock()
+	pulledAt := c.snapshots["zone"].pulledAt
+	c.mu.RUnlock()
+
+	atomic.StoreInt32(&truncate, 1)
+	c.pull(context.Background())
+
+	if n := testutil.CollectAndCount(c, "cloudflare_logs_http_responses"); n != 0 {
+		t.Errorf("expected no response series after a truncated pull, got %d", n)
+	}
+
+	c.mu.RLock()
+	if got := c.snapshots["zone"].pulledAt; !got.Equal(pulledAt) {
+		t.Errorf("expected the pull time of the complete pull, %s, got %s", pulledAt, got)
+	}
+	c.mu.RUnlock()
+
+	if n := atomic.LoadInt32(&errs); n != 1 {
+		t.Errorf("expected 1 error, got %d", n)
+	}
+
+	expected := `
+		# HELP cloudflare_logs_errors_total The number of errors that have occurred while collecting metrics, by zone and class
+		# TYPE cloudflare_logs_errors_total counter
+		cloudflare_logs_errors_total{class="truncated",zone_id="zone"} 1
+		# HELP cloudflare_logs_pull_success Whether the most recent pull of a zone from the Logpull API succeeded
+		# TYPE cloudflare_logs_pull_success gauge
+		cloudflare_logs_pull_success{zone_id="zone"} 0
+	`
+
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected), "cloudflare_logs_errors_total", "cloudflare_logs_pull_success"); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestCollectorSeriesTTL checks that in sliding mode, series which had log
+// entries in a previous period are reported as zero while they have none,
+// when the collector has a series TTL.
+func TestCollectorSeriesTTL(t *testing.T) {
+	var status int32 = 200
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jsonBody := fmt.Sprintf(`{"ClientRequestHost": "example.org", "EdgeResponseStatus": %d, "OriginResponseStatus": 200}`+"\n", atomic.LoadInt32(&status))
+		if _, err := w.Write([]byte(jsonBody)); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}))
+	defer ts.Close()
+
+	api := newLogpullAPI("", "")
+	api.setAPIProperties(ts.URL, ts.Client())
+
+	c, err := newCollector(api, []zone{{id: "zone"}}, collectorConfig{logPeriod: time.Minute, seriesTTL: time.Hour}, func(err error) {
+		t.Errorf("unexpected error: %s", err)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	c.pull(context.Background())
+	atomic.StoreInt32(&status, 503)
+	c.pull(context.Background())
+
+	expected := `
+		# HELP cloudflare_logs_http_responses Cloudflare HTTP responses, obtained via Logpull API
+		# TYPE cloudflare_logs_http_responses gauge
+		cloudflare_logs_http_responses{client_request_host="example.org",edge_response_status="200",origin_response_status="200",period="1m",zone_id="zone",zone_name=""} 0
+		cloudflare_logs_http_responses{client_request_host="example.org",edge_response_status="503",origin_response_status="200",period="1m",zone_id="zone",zone_name=""} 1
+	`
+
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected), "cloudflare_logs_http_responses"); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := newCollector(api, nil, collectorConfig{logPeriod: time.Minute, seriesTTL: -1}, func(error) {}); err == nil {
+		t.Error("expected error with a negative series TTL")
+	}
+}
+
+// TestCollectorServesSnapshot checks that the collector only calls the
+// Logpull API when pulling, never when collecting, and that it reports the
+// age of each stored snapshot.
+func TestCollectorServesSnapshot(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		host := path.Base(path.Dir(path.Dir(r.URL.Path))) + ".example.org"
+		jsonBody := []byte(`{"ClientRequestHost": "` + host + `", "EdgeResponseStatus": 200, "OriginResponseStatus": 200}` + "\n")
+		if _, err := w.Write(jsonBody); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}))
+	defer ts.Close()
+
+	api := newLogpullAPI("", "")
+	api.setAPIProperties(ts.URL, ts.Client())
+
+	c, err := newCollector(api, []zone{{id: "a"}, {id: "b"}}, collectorConfig{logPeriod: time.Minute}, func(err error) {
+		t.Errorf("unexpected error: %s", err)
+	})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	if n := testutil.CollectAndCount(c, "cloudflare_logs_http_responses"); n != 0 {
+		t.Errorf("expected no responses before the first pull, got %d", n)
+	}
+
+	c.pull(context.Background())
+
+	for i := 0; i < 3; i++ {
+		if n := testutil.CollectAndCount(c, "cloudflare_logs_snapshot_age_seconds"); n != 2 {
+			t.Errorf("expected a snapshot age for each of 2 zones, got %d", n)
+		}
+	}
+
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("expected 2 api requests, got %d", n)
+	}
+}
+
+// TestCollectorSetZones checks that zones added by setZones are pulled, and
+// that the metrics of removed zones are no longer reported.
+func TestCollectorSetZones(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := path.Base(path.Dir(path.Dir(r.URL.Path))) + ".example.org"
+		jsonBody := []byte(`{"ClientRequestHost": "` + host + `", "EdgeResponseStatus": 200, "OriginResponseStatus": 200}` + "\n")
+		if _, err := w.Write(jsonBody); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}))
+	defer ts.Close()
+
+	api := newLogpullAPI("", "")
+	api.setAPIProperties(ts.URL, ts.Client())
+
+	c, err := newCollector(api, nil, collectorConfig{logPeriod: time.Minute}, func(err error) {
+		t.Errorf("unexpected error: %s", err)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	c.pull(context.Background())
+
+	if n := testutil.CollectAndCount(c, "cloudflare_logs_http_responses"); n != 0 {
+		t.Errorf("expected no responses without zones, got %d", n)
+	}
+
+	c.setZones([]zone{{id: "a"}, {id: "b"}})
+	c.pull(context.Background())
+	c.setZones([]zone{{id: "b"}, {id: "c"}})
+
+	expected := `
+		# HELP cloudflare_logs_http_responses Cloudflare HTTP responses, obtained via Logpull API
+		# TYPE cloudflare_logs_http_responses gauge
+		cloudflare_logs_http_responses{client_request_host="b.example.org",edge_response_status="200",origin_response_status="200",period="1m",zone_id="b",zone_name=""} 1
+	`
+
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected), "cloudflare_logs_http_responses"); err != nil {
+		t.Error(err)
+	}
+
+	c.pull(context.Background())
+
+	if n := testutil.CollectAndCount(c, "cloudflare_logs_http_responses"); n != 2 {
+		t.Errorf("expected responses of 2 zones, got %d", n)
+	}
+}
+
+// TestCollectorSampleRate checks that log entries are requested with the
+// sample rate of their zone, falling back to that of the collector, and that
+// metrics are scaled by the inverse of the sample rate.
+func TestCollectorSampleRate(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		zoneID := path.Base(path.Dir(path.Dir(r.URL.Path)))
+		expected := map[string]string{"a": "0.1", "b": "0.5", "c": ""}[zoneID]
+		if got := r.URL.Query().Get("sample"); got != expected {
+			t.Errorf("zone %s: expected sample %q, got %q", zoneID, expected, got)
+		}
+
+		jsonBody := []byte(`{"ClientRequestHost": "` + zoneID + `.example.org", "EdgeResponseStatus": 200, "OriginResponseStatus": 200, "EdgeResponseBytes": 100}
+{"ClientRequestHost": "` + zoneID + `.example.org", "EdgeResponseStatus": 200, "OriginResponseStatus": 200, "EdgeResponseBytes": 300}` + "\n")
+		if _, err := w.Write(jsonBody); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}))
+	defer ts.Close()
+
+	api := newLogpullAPI("", "")
+	api.setAPIProperties(ts.URL, ts.Client())
+
+	zones := []zone{{id: "a"}, {id: "b", sampleRate: 0.5}, {id: "c", sampleRate: 1}}
+	c, err := newCollector(api, zones, collectorConfig{logPeriod: time.Minute, sampleRate: 0.1, metricFamilies: []string{"bandwidth"}}, func(err error) {
+		t.Errorf("unexpected error: %s", err)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	c.pull(context.Background())
+
+	expected := strings.NewReader(`
+		# HELP cloudflare_logs_edge_response_bytes Bytes sent by Cloudflare to clients, obtained via Logpull API
+		# TYPE cloudflare_logs_edge_response_bytes gauge
+		cloudflare_logs_edge_response_bytes{client_request_host="a.example.org",edge_response_status="200",period="1m",zone_id="a",zone_name=""} 4000
+		cloudflare_logs_edge_response_bytes{client_request_host="b.example.org",edge_response_status="200",period="1m",zone_id="b",zone_name=""} 800
+		cloudflare_logs_edge_response_bytes{client_request_host="c.example.org",edge_response_status="200",period="1m",zone_id="c",zone_name=""} 400
+		# HELP cloudflare_logs_http_responses Cloudflare HTTP responses, obtained via Logpull API
+		# TYPE cloudflare_logs_http_responses gauge
+		cloudflare_logs_http_responses{client_request_host="a.example.org",edge_response_status="200",origin_response_status="200",period="1m",zone_id="a",zone_name=""} 20
+		cloudflare_logs_http_responses{client_request_host="b.example.org",edge_response_status="200",origin_response_status="200",period="1m",zone_id="b",zone_name=""} 4
+		cloudflare_logs_http_responses{client_request_host="c.example.org",edge_response_status="200",origin_response_status="200",period="1m",zone_id="c",zone_name=""} 2
+		# HELP cloudflare_logs_sample_rate The fraction of the log entries of a zone which are pulled; metrics of zones with a sample rate below 1 are estimates
+		# TYPE cloudflare_logs_sample_rate gauge
+		cloudflare_logs_sample_rate{zone_id="a"} 0.1
+		cloudflare_logs_sample_rate{zone_id="b"} 0.5
+		cloudflare_logs_sample_rate{zone_id="c"} 1
+	`)
+
+	if err := testutil.CollectAndCompare(c, expected, "cloudflare_logs_http_responses", "cloudflare_logs_edge_response_bytes", "cloudflare_logs_sample_rate"); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestCollectorWindows checks that the window of a pull ends the end offset
+// before the pull, truncated to a whole minute if windows are aligned.
+func TestCollectorWindows(t *testing.T) {
+	var start, end time.Time
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		if start, err = time.Parse(time.RFC3339, r.URL.Query().Get("start")); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if end, err = time.Parse(time.RFC3339, r.URL.Query().Get("end")); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}))
+	defer ts.Close()
+
+	api := newLogpullAPI("", "")
+	api.setAPIProperties(ts.URL, ts.Client())
+
+	cfg := collectorConfig{logPeriod: 2 * time.Minute, endOffset: 5 * time.Minute, alignWindows: true}
+	c, err := newCollector(api, []zone{{id: "zone"}}, cfg, func(err error) {
+		t.Errorf("unexpected error: %s", err)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	before := time.Now()
+	c.pull(context.Background())
+
+	if latest := before.Add(-5 * time.Minute); end.After(latest) || !end.After(latest.Add(-2*time.Minute)) {
+		t.Errorf("expected the window to end shortly before %s, got %s", latest, end)
+	}
+
+	if end.Second() != 0 {
+		t.Errorf("expected the window to end on a whole minute, got %s", end)
+	}
+
+	if !start.Equal(end.Add(-2 * time.Minute)) {
+		t.Errorf("expected the window to start 2m before %s, got %s", end, start)
+	}
+
+	for _, cfg := range []collectorConfig{
+		{logPeriod: time.Minute, endOffset: 30 * time.Second},
+		{logPeriod: 90 * time.Second, alignWindows: true},
+		{logPeriod: logPeriodRange - time.Minute, endOffset: 2 * time.Minute},
+		{logPeriod: logPeriodRange - time.Minute, alignWindows: true},
+	} {
+		if _, err := newCollector(api, nil, cfg, func(error) {}); err == nil {
+			t.Errorf("expected error with %+v", cfg)
+		}
+	}
+
+	if _, err := newCollector(api, nil, collectorConfig{logPeriod: logPeriodRange - time.Minute}, func(error) {}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+// TestCollectorTimestamps checks that the metrics derived from log entries
+// are reported with the end of their window as their timestamp, and that
+// other metrics are not, when timestamps are enabled.
+func TestCollectorTimestamps(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jsonBody := []byte(`{"ClientRequestHost": "example.org", "EdgeResponseStatus": 200, "OriginResponseStatus": 200}` + "\n")
+		if _, err := w.Write(jsonBody); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}))
+	defer ts.Close()
+
+	api := newLogpullAPI("", "")
+	api.setAPIProperties(ts.URL, ts.Client())
+
+	c, err := newCollector(api, []zone{{id: "zone"}}, collectorConfig{logPeriod: time.Minute, timestamps: true}, func(err error) {
+		t.Errorf("unexpected error: %s", err)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	c.pull(context.Background())
+
+	c.mu.RLock()
+	end := c.snapshots["zone"].end
+	c.mu.RUnlock()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var found bool
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			switch mf.GetName() {
+			case "cloudflare_logs_http_responses":
+				found = true
+				if got, expected := m.GetTimestampMs(), end.UnixNano()/int64(time.Millisecond); got != expected {
+					t.Errorf("expected timestamp %d, got %d", expected, got)
+				}
+			case "cloudflare_logs_snapshot_age_seconds":
+				if m.TimestampMs != nil {
+					t.Errorf("expected no timestamp, got %d", m.GetTimestampMs())
+				}
+			}
+		}
+	}
+
+	if !found {
+		t.Error("expected cloudflare_logs_http_responses to be reported")
+	}
+}
+
+// TestCollectorMinuteBuckets checks that with minute buckets, log entries are
+// aggregated by the minute of their EdgeStartTimestamp, and that the minutes
+// of a window are replayed one per minute after the tick of the pull, each
+// with its own timestamp.
+func TestCollectorMinuteBuckets(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.URL.Query().Get("timestamps"); got != "unixnano" {
+			t.Errorf("expected timestamps unixnano, got %q", got)
+		}
+
+		start, err := time.Parse(time.RFC3339, r.URL.Query().Get("start"))
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+
+		// One entry in the first minute, two in the second, and none in
+		// the third.
+		var jsonBody string
+		for _, offset := range []time.Duration{30 * time.Second, 70 * time.Second, 110 * time.Second} {
+			jsonBody += fmt.Sprintf(`{"ClientRequestHost": "example.org", "EdgeResponseStatus": 200, "OriginResponseStatus": 200, "EdgeStartTimestamp": %d}`+"\n", start.Add(offset).UnixNano())
+		}
+		if _, err := w.Write([]byte(jsonBody)); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}))
+	defer ts.Close()
+
+	api := newLogpullAPI("", "")
+	api.setAPIProperties(ts.URL, ts.Client())
+
+	cfg := collectorConfig{logPeriod: 3 * time.Minute, alignWindows: true, minuteBuckets: true}
+	c, err := newCollector(api, []zone{{id: "zone"}}, cfg, func(err error) {
+		t.Errorf("unexpected error: %s", err)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	tick := time.Now()
+	now := tick
+	c.now = func() time.Time { return now }
+
+	c.pull(context.Background())
+
+	c.mu.RLock()
+	end := c.snapshots["zone"].end
+	c.mu.RUnlock()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+
+	for i, expected := range []float64{1, 2, 0} {
+		// Replay minute i, i+1 minutes after the tick of the pull.
+		now = tick.Add(time.Duration(i+1) * time.Minute)
+
+		mfs, err := reg.Gather()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		var got float64
+		for _, mf := range mfs {
+			if mf.GetName() != "cloudflare_logs_http_responses" {
+				continue
+			}
+			for _, m := range mf.GetMetric() {
+				got += m.GetGauge().GetValue()
+				for _, l := range m.GetLabel() {
+					if l.GetName() == "period" && l.GetValue() != "1m" {
+						t.Errorf("expected period 1m, got %s", l.GetValue())
+					}
+				}
+				minuteEnd := end.Add(-time.Duration(2-i) * time.Minute)
+				if m.GetTimestampMs() != minuteEnd.UnixNano()/int64(time.Millisecond) {
+					t.Errorf("minute %d: expected timestamp %s, got %d", i, minuteEnd, m.GetTimestampMs())
+				}
+			}
+		}
+
+		if got != expected {
+			t.Errorf("minute %d: expected %v responses, got %v", i, expected, got)
+		}
+	}
+
+	for _, cfg := range []collectorConfig{
+		{logPeriod: 3 * time.Minute, minuteBuckets: true},
+		{logPeriod: 3 * time.Minute, alignWindows: true, windowMode: windowContiguous, minuteBuckets: true},
+		{logPeriod: time.Minute, alignWindows: true, minuteBuckets: true},
+	} {
+		if _, err := newCollector(api, nil, cfg, func(error) {}); err == nil {
+			t.Errorf("expected error with %+v", cfg)
+		}
+	}
+}
+
+// TestCollectorMinuteBucketsReplay checks that the minutes of consecutive
+// windows are each replayed for a whole minute, whether their pulls are slow
+// or fast, so that scraping once a minute yields every one of them.
+func TestCollectorMinuteBucketsReplay(t *testing.T) {
+	var mu sync.Mutex
+	now := time.Now()
+	var duration time.Duration
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start, err := time.Parse(time.RFC3339, r.URL.Query().Get("start"))
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+
+		// One entry in the first minute, two in the second, and one in
+		// the third.
+		var jsonBody string
+		for _, offset := range []time.Duration{30 * time.Second, 70 * time.Second, 110 * time.Second, 150 * time.Second} {
+			jsonBody += fmt.Sprintf(`{"ClientRequestHost": "example.org", "EdgeResponseStatus": 200, "OriginResponseStatus": 200, "EdgeStartTimestamp": %d}`+"\n", start.Add(offset).UnixNano())
+		}
+
+		// The pull takes as long as the test decides.
+		mu.Lock()
+		now = now.Add(duration)
+		mu.Unlock()
+
+		if _, err := w.Write([]byte(jsonBody)); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}))
+	defer ts.Close()
+
+	api := newLogpullAPI("", "")
+	api.setAPIProperties(ts.URL, ts.Client())
+
+	cfg := collectorConfig{logPeriod: 3 * time.Minute, alignWindows: true, minuteBuckets: true}
+	c, err := newCollector(api, []zone{{id: "zone"}}, cfg, func(err error) {
+		t.Errorf("unexpected error: %s", err)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	c.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	setNow := func(next time.Time) {
+		mu.Lock()
+		defer mu.Unlock()
+		now = next
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+
+	// scrape returns the timestamp and the value of the responses.
+	scrape := func() (int64, float64) {
+		mfs, err := reg.Gather()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		var timestamp int64
+		var value float64
+		for _, mf := range mfs {
+			if mf.GetName() != "cloudflare_logs_http_responses" {
+				continue
+			}
+			for _, m := range mf.GetMetric() {
+				timestamp = m.GetTimestampMs()
+				value += m.GetGauge().GetValue()
+			}
+		}
+		return timestamp, value
+	}
+
+	tick := now
+	end := c.windowEnd(tick)
+	got := map[int64]float64{}
+
+	// The first pull takes 50 seconds, and the second 5 seconds. Scrapes
+	// happen once a minute, 45 seconds past the ticks.
+	duration = 50 * time.Second
+	c.pull(context.Background())
+	for i := 1; i < 3; i++ {
+		setNow(tick.Add(time.Duration(i)*time.Minute + 45*time.Second))
+		timestamp, value := scrape()
+		got[timestamp] = value
+	}
+
+	duration = 5 * time.Second
+	setNow(tick.Add(3 * time.Minute))
+	c.pull(context.Background())
+	for i := 3; i < 7; i++ {
+		setNow(tick.Add(time.Duration(i)*time.Minute + 45*time.Second))
+		timestamp, value := scrape()
+		got[timestamp] = value
+	}
+
+	expected := map[int64]float64{}
+	for i, value := range []float64{1, 2, 1, 1, 2, 1} {
+		minuteEnd := end.Add(time.Duration(i-2) * time.Minute)
+		expected[minuteEnd.UnixNano()/int64(time.Millisecond)] = value
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected minutes %v, got %v", expected, got)
+	}
+}
+
+// TestCollectorPullTimeout checks that a pull is cancelled once it has taken
+// longer than the log period, and that pulls cancelled because the collector
+// is stopped are neither reported as errors nor stored.
+func TestCollectorPullTimeout(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	api := newLogpullAPI("", "")
+	api.setAPIProperties(ts.URL, ts.Client())
+
+	var errs int32
+	c, err := newCollector(api, []zone{{id: "zone"}}, collectorConfig{logPeriod: 100 * time.Millisecond}, func(err error) {
+		atomic.AddInt32(&errs, 1)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	start := time.Now()
+	c.pull(context.Background())
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected pull to time out after 100ms, took %s", elapsed)
+	}
+
+	if n := atomic.LoadInt32(&errs); n != 1 {
+		t.Errorf("expected 1 error from the timed out pull, got %d", n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	c.pull(ctx)
+
+	if n := atomic.LoadInt32(&errs); n != 1 {
+		t.Errorf("expected no error from the cancelled pull, got %d", n-1)
+	}
+}
+
+// TestCollectorContiguousWindows checks that, in contiguous mode, each pull
+// requests exactly the interval following the previous successful pull, and
+// that responses are accumulated into `cloudflare_logs_http_responses_total`.
+func TestCollectorContiguousWindows(t *testing.T) {
+	var mu sync.Mutex
+	var windows [][2]string
+	fail := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		windows = append(windows, [2]string{r.URL.Query().Get("start"), r.URL.Query().Get("end")})
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		jsonBody := []byte(`{"ClientRequestHost": "example.org", "EdgeResponseStatus": 200, "OriginResponseStatus": 200}` + "\n")
+		if _, err := w.Write(jsonBody); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}))
+	defer ts.Close()
+
+	api := newLogpullAPI("", "")
+	api.setAPIProperties(ts.URL, ts.Client())
+	api.retryPolicy = retryPolicy{}
+
+	cfg := collectorConfig{logPeriod: time.Minute, windowMode: windowContiguous}
+	c, err := newCollector(api, []zone{{id: "zone"}}, cfg, func(error) {})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	// Windows are requested with a resolution of one second, so the clock
+	// advances by a second between pulls to make sure that each window is
+	// distinct.
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	for _, f := range []bool{false, true, false} {
+		mu.Lock()
+		fail = f
+		mu.Unlock()
+		c.pull(context.Background())
+		now = now.Add(time.Second)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(windows) != 3 {
+		t.Fatalf("expected 3 api requests, got %d", len(windows))
+	}
+
+	if windows[1][0] != windows[0][1] {
+		t.Errorf("expected second window to start at %s, got %s", windows[0][1], windows[1][0])
+	}
+
+	if windows[2][0] != windows[0][1] {
+		t.Errorf("expected failed window to be retried from %s, got %s", windows[0][1], windows[2][0])
+	}
+
+	expected := strings.NewReader(`
+		# HELP cloudflare_logs_http_responses_total Cloudflare HTTP responses, obtained via Logpull API
+		# TYPE cloudflare_logs_http_responses_total counter
+		cloudflare_logs_http_responses_total{client_request_host="example.org",edge_response_status="200",origin_response_status="200",zone_id="zone",zone_name=""} 2
+	`)
+
+	if err := testutil.CollectAndCompare(c, expected, "cloudflare_logs_http_responses_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestCollectorInherit checks that a contiguous mode collector which replaces
+// another on reload pulls the windows following those pulled by the other,
+// and carries its counters over only if their metrics are the same.
+func TestCollectorInherit(t *testing.T) {
+	var mu sync.Mutex
+	var windows [][2]string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		windows = append(windows, [2]string{r.URL.Query().Get("start"), r.URL.Query().Get("end")})
+		jsonBody := []byte(`{"ClientRequestHost": "example.org", "EdgeResponseStatus": 200, "OriginResponseStatus": 200}` + "\n")
+		if _, err := w.Write(jsonBody); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}))
+	defer ts.Close()
+
+	api := newLogpullAPI("", "")
+	api.setAPIProperties(ts.URL, ts.Client())
+	api.retryPolicy = retryPolicy{}
+
+	now := time.Now()
+	clock := func() time.Time { return now }
+
+	cfg := collectorConfig{logPeriod: time.Minute, windowMode: windowContiguous}
+	old, err := newCollector(api, []zone{{id: "zone"}}, cfg, func(error) {})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	old.now = clock
+	for i := 0; i < 2; i++ {
+		old.pull(context.Background())
+		now = now.Add(time.Second)
+	}
+
+	for _, tt := range []struct {
+		cfg      collectorConfig
+		expected string
+	}{
+		{
+			cfg: collectorConfig{logPeriod: 2 * time.Minute, windowMode: windowContiguous},
+			expected: `
+				# HELP cloudflare_logs_http_responses_total Cloudflare HTTP responses, obtained via Logpull API
+				# TYPE cloudflare_logs_http_responses_total counter
+				cloudflare_logs_http_responses_total{client_request_host="example.org",edge_response_status="200",origin_response_status="200",zone_id="zone",zone_name=""} 3
+			`,
+		},
+		{
+			cfg: collectorConfig{logPeriod: time.Minute, windowMode: windowContiguous, labelFields: []string{"ClientRequestHost"}},
+			expected: `
+				# HELP cloudflare_logs_http_responses_total Cloudflare HTTP responses, obtained via Logpull API
+				# TYPE cloudflare_logs_http_responses_total counter
+				cloudflare_logs_http_responses_total{client_request_host="example.org",zone_id="zone",zone_name=""} 1
+			`,
+		},
+	} {
+		c, err := newCollector(api, []zone{{id: "zone"}}, tt.cfg, func(error) {})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		c.now = clock
+		c.inherit(old)
+
+		mu.Lock()
+		windows = nil
+		mu.Unlock()
+
+		c.pull(context.Background())
+
+		mu.Lock()
+		if len(windows) != 1 {
+			t.Fatalf("expected 1 api request, got %d", len(windows))
+		}
+		if expected := old.snapshots["zone"].end.Format(time.RFC3339); windows[0][0] != expected {
+			t.Errorf("expected window to start at %s, got %s", expected, windows[0][0])
+		}
+		mu.Unlock()
+
+		if err := testutil.CollectAndCompare(c, strings.NewReader(tt.expected), "cloudflare_logs_http_responses_total"); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// TestCollectorContiguousRetention checks that, in contiguous mode, a pull
+// following a previous pull which is older than the Logpull API's retention
+// requests no logs beyond the retention, with or without aligned windows.
+func TestCollectorContiguousRetention(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start, err := time.Parse(time.RFC3339, r.URL.Query().Get("start"))
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if start.Before(time.Now().Add(-logRetention)) {
+			w.WriteHeader(http.StatusBadRequest)
+			_, err = w.Write([]byte("bad query: error parsing time: invalid time range: too early: logs older than 168h0m0s are not available"))
+			if err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		}
+	}))
+	defer ts.Close()
+
+	api := newLogpullAPI("", "")
+	api.setAPIProperties(ts.URL, ts.Client())
+	api.retryPolicy = retryPolicy{}
+
+	for _, align := range []bool{false, true} {
+		cfg := collectorConfig{logPeriod: 24 * time.Hour, windowMode: windowContiguous, alignWindows: align}
+		c, err := newCollector(api, []zone{{id: "zone"}}, cfg, func(err error) {
+			t.Errorf("unexpected error with aligned windows %t: %s", align, err)
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		c.snapshots["zone"] = &snapshot{
+			metrics:   newAggregation(),
+			countries: newCountryCap(),
+			end:       time.Now().Add(-logRetention - time.Hour),
+		}
+		c.pull(context.Background())
+	}
+}
+
+// TestCollectorLabelFields checks that the labels of the
+// `cloudflare_logs_http_responses` metric follow the configured fields.
+func TestCollectorLabelFields(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jsonBody := []byte(`{"ClientRequestMethod": "GET", "CacheCacheStatus": "hit", "EdgeColoCode": "LHR"}` + "\n" +
+			`{"ClientRequestMethod": "GET", "CacheCacheStatus": "hit", "EdgeColoCode": "LHR"}` + "\n" +
+			`{"ClientRequestMethod": "POST", "CacheCacheStatus": "dynamic", "EdgeColoCode": "LHR"}` + "\n")
+		if _, err := w.Write(jsonBody); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}))
+	defer ts.Close()
+
+	api := newLogpullAPI("", "")
+	api.setAPIProperties(ts.URL, ts.Client())
+
+	cfg := collectorConfig{
+		logPeriod:   time.Minute,
+		labelFields: []string{"ClientRequestMethod", "CacheCacheStatus", "EdgeColoCode"},
+	}
+	c, err := newCollector(api, []zone{{id: "zone"}}, cfg, func(err error) {
+		t.Errorf("unexpected error: %s", err)
+	})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	c.pull(context.Background())
+
+	expected := strings.NewReader(`
+		# HELP cloudflare_logs_http_responses Cloudflare HTTP responses, obtained via Logpull API
+		# TYPE cloudflare_logs_http_responses gauge
+		cloudflare_logs_http_responses{cache_cache_status="hit",client_request_method="GET",edge_colo_code="LHR",period="1m",zone_id="zone",zone_name=""} 2
+		cloudflare_logs_http_responses{cache_cache_status="dynamic",client_request_method="POST",edge_colo_code="LHR",period="1m",zone_id="zone",zone_name=""} 1
+	`)
+
+	if err := testutil.CollectAndCompare(c, expected, "cloudflare_logs_http_responses"); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestCollectorInvalidLabelFields checks that newCollector rejects invalid
+// and duplicate label fields, and those whose labels are reserved for the
+// zone.
+func TestCollectorInvalidLabelFields(t *testing.T) {
+	for _, fields := range [][]string{
+		{"ClientRequestHost", "ClientRequestHost"},
+		{"client-request-host"},
+		{""},
+		{"ZoneID"},
+		{"ZoneName"},
+	} {
+		cfg := collectorConfig{logPeriod: time.Minute, labelFields: fields}
+		if _, err := newCollector(newLogpullAPI("", ""), []zone{{id: "zone"}}, cfg, func(error) {}); err == nil {
+			t.Errorf("expected error with label fields %q", fields)
+		}
+	}
+}
@@ -0,0 +1,544 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	prommodel "github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// defaultListenAddr is the address the exporter listens on, unless another
+// is configured.
+const defaultListenAddr = ":9299"
+
+// defaultLogPeriod is the period of logs covered by each pull, unless another
+// is configured.
+const defaultLogPeriod = prommodel.Duration(time.Minute)
+
+// defaultRateLimitWindow is the window of the Logpull API request budget,
+// unless another window is configured.
+const defaultRateLimitWindow = prommodel.Duration(time.Minute)
+
+// defaultDiscoveryInterval is how often zones are discovered, unless another
+// interval is configured.
+const defaultDiscoveryInterval = prommodel.Duration(10 * time.Minute)
+
+// config is the configuration of the exporter. It is read either from a YAML
+// configuration file, or from environment variables.
+type config struct {
+	ListenAddr     string             `yaml:"listen_addr"`
+	Credentials    credentialsConfig  `yaml:"credentials"`
+	Zones          []zoneConfig       `yaml:"zones"`
+	Discovery      *discoveryConfig   `yaml:"discovery"`
+	LogPeriod      prommodel.Duration `yaml:"log_period"`
+	EndOffset      prommodel.Duration `yaml:"end_offset"`
+	AlignWindows   bool               `yaml:"align_windows"`
+	Timestamps     bool               `yaml:"timestamps"`
+	MinuteBuckets  bool               `yaml:"minute_buckets"`
+	WindowMode     string             `yaml:"window_mode"`
+	Metrics        []string           `yaml:"metrics"`
+	LabelFields    []string           `yaml:"label_fields"`
+	LatencyBuckets []float64          `yaml:"latency_buckets"`
+	SizeBuckets    []float64          `yaml:"size_buckets"`
+	CountryTopN    int                `yaml:"country_top_n"`
+	Routes         []string           `yaml:"routes"`
+	Filters        []filterConfig     `yaml:"filters"`
+	SampleRate     float64            `yaml:"sample_rate"`
+	SeriesTTL      prommodel.Duration `yaml:"series_ttl"`
+
+	// MaxConcurrentPulls and RateLimitRequests limit the requests made to
+	// the Logpull API, across all zones. Zero is unlimited.
+	MaxConcurrentPulls int                `yaml:"max_concurrent_pulls"`
+	RateLimitRequests  int                `yaml:"rate_limit_requests"`
+	RateLimitWindow    prommodel.Duration `yaml:"rate_limit_window"`
+}
+
+// credentialsConfig configures how to authenticate with Cloudflare's API.
+// Exactly one of APIToken, APIKey or APIUserServiceKey must be set, and
+// APIEmail must be set along with APIKey.
+type credentialsConfig struct {
+	APIEmail          string    `yaml:"api_email"`
+	APIKey            secretRef `yaml:"api_key"`
+	APIToken          secretRef `yaml:"api_token"`
+	APIUserServiceKey secretRef `yaml:"api_user_service_key"`
+}
+
+// secretRef references a secret held in an environment variable or in a file,
+// so that secrets never need to be written into the configuration file.
+type secretRef struct {
+	Env  string `yaml:"env"`
+	File string `yaml:"file"`
+}
+
+// isSet reports whether the secretRef references a secret.
+func (r secretRef) isSet() bool {
+	return r.Env != "" || r.File != ""
+}
+
+// resolve returns the secret referenced by the secretRef. Returns an error if
+// the secret cannot be read or is empty.
+func (r secretRef) resolve() (string, error) {
+	var secret string
+
+	switch {
+	case r.Env != "" && r.File != "":
+		return "", errors.New("only one of env or file may be set")
+	case r.Env != "":
+		secret = os.Getenv(r.Env)
+		if secret == "" {
+			return "", fmt.Errorf("environment variable %s is empty", r.Env)
+		}
+	case r.File != "":
+		b, err := ioutil.ReadFile(r.File)
+		if err != nil {
+			return "", err
+		}
+		secret = strings.TrimSpace(string(b))
+		if secret == "" {
+			return "", fmt.Errorf("file %s is empty", r.File)
+		}
+	}
+
+	return secret, nil
+}
+
+// zoneConfig configures a single zone from which logs are pulled. At least
+// one of Name or ID must be set. If ID is set, it is used as is, so that the
+// credentials need not allow reading zones; otherwise, it is resolved from
+// Name.
+type zoneConfig struct {
+	Name       string         `yaml:"name"`
+	ID         string         `yaml:"id"`
+	Filters    []filterConfig `yaml:"filters"`
+	SampleRate float64        `yaml:"sample_rate"`
+}
+
+// discoveryConfig configures the discovery of zones through the Cloudflare
+// API. Zones are discovered if they are active and match all of the criteria
+// which are set. At most one of NamePattern or NameRegex may be set.
+type discoveryConfig struct {
+	AccountID       string             `yaml:"account_id"`
+	NamePattern     string             `yaml:"name_pattern"`
+	NameRegex       string             `yaml:"name_regex"`
+	Plans           []string           `yaml:"plans"`
+	RefreshInterval prommodel.Duration `yaml:"refresh_interval"`
+}
+
+// filterConfig configures a fieldFilter. Exactly one of Regex or NotRegex must
+// be set.
+type filterConfig struct {
+	Field    string `yaml:"field"`
+	Regex    string `yaml:"regex"`
+	NotRegex string `yaml:"not_regex"`
+}
+
+// filter creates the fieldFilter described by the filterConfig.
+func (fc filterConfig) filter() (fieldFilter, error) {
+	if (fc.Regex == "") == (fc.NotRegex == "") {
+		return fieldFilter{}, fmt.Errorf("filter on %s: exactly one of regex or not_regex must be set", fc.Field)
+	}
+
+	if fc.Regex != "" {
+		return newFieldFilter(fc.Field, fc.Regex, false)
+	}
+	return newFieldFilter(fc.Field, fc.NotRegex, true)
+}
+
+// loadConfig reads the configuration of the exporter from the given YAML file
+// or, if path is empty, from environment variables. Returns an error if the
+// configuration cannot be read or is invalid.
+func loadConfig(path string) (*config, error) {
+	var cfg *config
+	var err error
+
+	if path == "" {
+		cfg, err = configFromEnv()
+	} else {
+		cfg, err = configFromFile(path)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// configFromFile reads the configuration of the exporter from the given YAML
+// file. Unknown keys are rejected, so that typos do not go unnoticed.
+func configFromFile(path string) (*config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+
+	cfg := &config{
+		ListenAddr:         defaultListenAddr,
+		LogPeriod:          defaultLogPeriod,
+		MaxConcurrentPulls: defaultMaxConcurrentPulls,
+		RateLimitWindow:    defaultRateLimitWindow,
+	}
+
+	if err := yaml.UnmarshalStrict(b, cfg); err != nil {
+		return nil, fmt.Errorf("parsing config file: %w", err)
+	}
+
+	if cfg.Discovery != nil && cfg.Discovery.RefreshInterval == 0 {
+		cfg.Discovery.RefreshInterval = defaultDiscoveryInterval
+	}
+
+	return cfg, nil
+}
+
+// configFromEnv reads the configuration of the exporter from environment
+// variables.
+func configFromEnv() (*config, error) {
+	cfg := &config{
+		ListenAddr:  os.Getenv("EXPORTER_LISTEN_ADDR"),
+		LogPeriod:   defaultLogPeriod,
+		WindowMode:  os.Getenv("EXPORTER_WINDOW_MODE"),
+		Metrics:     splitList(os.Getenv("EXPORTER_METRICS")),
+		LabelFields: splitList(os.Getenv("EXPORTER_LABEL_FIELDS")),
+		// Route rules may contain commas, e.g. in regular
+		// expressions, so they are separated by whitespace instead.
+		Routes:             strings.Fields(os.Getenv("EXPORTER_ROUTES")),
+		MaxConcurrentPulls: defaultMaxConcurrentPulls,
+		RateLimitWindow:    defaultRateLimitWindow,
+	}
+
+	if cfg.ListenAddr == "" {
+		cfg.ListenAddr = defaultListenAddr
+	}
+
+	// Credentials are referenced, rather than read, so that they are
+	// resolved in the same way as those of a configuration file.
+	for _, c := range []struct {
+		ref *secretRef
+		env string
+	}{
+		{&cfg.Credentials.APIKey, "CLOUDFLARE_API_KEY"},
+		{&cfg.Credentials.APIToken, "CLOUDFLARE_API_TOKEN"},
+		{&cfg.Credentials.APIUserServiceKey, "CLOUDFLARE_API_USER_SERVICE_KEY"},
+	} {
+		if os.Getenv(c.env) != "" {
+			c.ref.Env = c.env
+		}
+	}
+	cfg.Credentials.APIEmail = os.Getenv("CLOUDFLARE_API_EMAIL")
+
+	for _, name := range splitList(os.Getenv("CLOUDFLARE_ZONE_NAMES")) {
+		cfg.Zones = append(cfg.Zones, zoneConfig{Name: name})
+	}
+
+	for _, id := range splitList(os.Getenv("CLOUDFLARE_ZONE_IDS")) {
+		cfg.Zones = append(cfg.Zones, zoneConfig{ID: id})
+	}
+
+	var err error
+
+	if discover := os.Getenv("EXPORTER_DISCOVER_ZONES"); discover != "" {
+		enabled, err := strconv.ParseBool(discover)
+		if err != nil {
+			return nil, fmt.Errorf("EXPORTER_DISCOVER_ZONES must be a boolean: %w", err)
+		}
+
+		if enabled {
+			cfg.Discovery = &discoveryConfig{
+				AccountID:       os.Getenv("CLOUDFLARE_ACCOUNT_ID"),
+				NamePattern:     os.Getenv("EXPORTER_DISCOVERY_NAME_PATTERN"),
+				NameRegex:       os.Getenv("EXPORTER_DISCOVERY_NAME_REGEX"),
+				Plans:           splitList(os.Getenv("EXPORTER_DISCOVERY_PLANS")),
+				RefreshInterval: defaultDiscoveryInterval,
+			}
+
+			if interval := os.Getenv("EXPORTER_DISCOVERY_INTERVAL"); interval != "" {
+				if cfg.Discovery.RefreshInterval, err = prommodel.ParseDuration(interval); err != nil {
+					return nil, fmt.Errorf("EXPORTER_DISCOVERY_INTERVAL must be a duration: %w", err)
+				}
+			}
+		}
+	}
+
+	if cfg.LatencyBuckets, err = parseBuckets(os.Getenv("EXPORTER_LATENCY_BUCKETS")); err != nil {
+		return nil, fmt.Errorf("EXPORTER_LATENCY_BUCKETS must be a comma-separated list of numbers: %w", err)
+	}
+
+	if cfg.SizeBuckets, err = parseBuckets(os.Getenv("EXPORTER_SIZE_BUCKETS")); err != nil {
+		return nil, fmt.Errorf("EXPORTER_SIZE_BUCKETS must be a comma-separated list of numbers: %w", err)
+	}
+
+	if countryTopN := os.Getenv("EXPORTER_COUNTRY_TOP_N"); countryTopN != "" {
+		if cfg.CountryTopN, err = strconv.Atoi(countryTopN); err != nil {
+			return nil, fmt.Errorf("EXPORTER_COUNTRY_TOP_N must be an integer: %w", err)
+		}
+	}
+
+	if sampleRate := os.Getenv("EXPORTER_SAMPLE_RATE"); sampleRate != "" {
+		if cfg.SampleRate, err = strconv.ParseFloat(sampleRate, 64); err != nil {
+			return nil, fmt.Errorf("EXPORTER_SAMPLE_RATE must be a number: %w", err)
+		}
+	}
+
+	if logPeriod := os.Getenv("EXPORTER_LOG_PERIOD"); logPeriod != "" {
+		if cfg.LogPeriod, err = prommodel.ParseDuration(logPeriod); err != nil {
+			return nil, fmt.Errorf("EXPORTER_LOG_PERIOD must be a duration: %w", err)
+		}
+	}
+
+	if endOffset := os.Getenv("EXPORTER_END_OFFSET"); endOffset != "" {
+		if cfg.EndOffset, err = prommodel.ParseDuration(endOffset); err != nil {
+			return nil, fmt.Errorf("EXPORTER_END_OFFSET must be a duration: %w", err)
+		}
+	}
+
+	if alignWindows := os.Getenv("EXPORTER_ALIGN_WINDOWS"); alignWindows != "" {
+		if cfg.AlignWindows, err = strconv.ParseBool(alignWindows); err != nil {
+			return nil, fmt.Errorf("EXPORTER_ALIGN_WINDOWS must be a boolean: %w", err)
+		}
+	}
+
+	if timestamps := os.Getenv("EXPORTER_TIMESTAMPS"); timestamps != "" {
+		if cfg.Timestamps, err = strconv.ParseBool(timestamps); err != nil {
+			return nil, fmt.Errorf("EXPORTER_TIMESTAMPS must be a boolean: %w", err)
+		}
+	}
+
+	if minuteBuckets := os.Getenv("EXPORTER_MINUTE_BUCKETS"); minuteBuckets != "" {
+		if cfg.MinuteBuckets, err = strconv.ParseBool(minuteBuckets); err != nil {
+			return nil, fmt.Errorf("EXPORTER_MINUTE_BUCKETS must be a boolean: %w", err)
+		}
+	}
+
+	if seriesTTL := os.Getenv("EXPORTER_SERIES_TTL"); seriesTTL != "" {
+		if cfg.SeriesTTL, err = prommodel.ParseDuration(seriesTTL); err != nil {
+			return nil, fmt.Errorf("EXPORTER_SERIES_TTL must be a duration: %w", err)
+		}
+	}
+
+	if maxConcurrentPulls := os.Getenv("EXPORTER_MAX_CONCURRENT_PULLS"); maxConcurrentPulls != "" {
+		if cfg.MaxConcurrentPulls, err = strconv.Atoi(maxConcurrentPulls); err != nil {
+			return nil, fmt.Errorf("EXPORTER_MAX_CONCURRENT_PULLS must be an integer: %w", err)
+		}
+	}
+
+	if rateLimitRequests := os.Getenv("EXPORTER_RATE_LIMIT_REQUESTS"); rateLimitRequests != "" {
+		if cfg.RateLimitRequests, err = strconv.Atoi(rateLimitRequests); err != nil {
+			return nil, fmt.Errorf("EXPORTER_RATE_LIMIT_REQUESTS must be an integer: %w", err)
+		}
+	}
+
+	if rateLimitWindow := os.Getenv("EXPORTER_RATE_LIMIT_WINDOW"); rateLimitWindow != "" {
+		if cfg.RateLimitWindow, err = prommodel.ParseDuration(rateLimitWindow); err != nil {
+			return nil, fmt.Errorf("EXPORTER_RATE_LIMIT_WINDOW must be a duration: %w", err)
+		}
+	}
+
+	return cfg, nil
+}
+
+// splitList splits a comma-separated list, trimming whitespace around each
+// element. An empty string yields no elements.
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+
+	var elems []string
+	for _, elem := range strings.Split(s, ",") {
+		elems = append(elems, strings.TrimSpace(elem))
+	}
+	return elems
+}
+
+// parseBuckets parses a comma-separated list of histogram bucket upper
+// bounds. An empty string yields no buckets.
+func parseBuckets(s string) ([]float64, error) {
+	var buckets []float64
+	for _, bucket := range splitList(s) {
+		v, err := strconv.ParseFloat(bucket, 64)
+		if err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, v)
+	}
+	return buckets, nil
+}
+
+// validate returns an error if the configuration is invalid. Settings which
+// are validated by newCollector are not validated again.
+func (cfg *config) validate() error {
+	creds := cfg.Credentials
+
+	numAuthSettings := 0
+	for _, ref := range []secretRef{creds.APIToken, creds.APIKey, creds.APIUserServiceKey} {
+		if ref.isSet() {
+			numAuthSettings++
+		}
+	}
+
+	if numAuthSettings != 1 {
+		return errors.New("exactly one of an API token, API key or user service key must be specified")
+	}
+
+	if creds.APIKey.isSet() && creds.APIEmail == "" {
+		return errors.New("an API key was specified without an API email; both must be provided")
+	}
+
+	if len(cfg.Zones) == 0 && cfg.Discovery == nil {
+		return errors.New("at least one zone must be specified, unless zone discovery is enabled")
+	}
+
+	names := make(map[string]bool, len(cfg.Zones))
+	ids := make(map[string]bool, len(cfg.Zones))
+	for _, z := range cfg.Zones {
+		if z.Name == "" && z.ID == "" {
+			return errors.New("every zone must have a name or an ID")
+		}
+		if z.ID != "" && !zoneIDRegexp.MatchString(z.ID) {
+			return fmt.Errorf("invalid zone ID %q: must be 32 lowercase hexadecimal characters", z.ID)
+		}
+		if z.Name != "" && names[z.Name] {
+			return fmt.Errorf("zone %s is specified more than once", z.Name)
+		}
+		if z.ID != "" && ids[z.ID] {
+			return fmt.Errorf("zone %s is specified more than once", z.ID)
+		}
+		names[z.Name] = true
+		ids[z.ID] = true
+		for _, fc := range z.Filters {
+			if _, err := fc.filter(); err != nil {
+				return fmt.Errorf("zone %s: %w", z.Name+z.ID, err)
+			}
+		}
+		if !validSampleRate(z.SampleRate) {
+			return fmt.Errorf("zone %s: sample rate must be greater than 0 and at most 1", z.Name+z.ID)
+		}
+	}
+
+	if cfg.MaxConcurrentPulls < 0 {
+		return errors.New("max concurrent pulls must not be negative")
+	}
+
+	if cfg.RateLimitRequests < 0 {
+		return errors.New("rate limit requests must not be negative")
+	}
+
+	if cfg.RateLimitRequests > 0 && cfg.RateLimitWindow <= 0 {
+		return errors.New("rate limit window must be positive")
+	}
+
+	if d := cfg.Discovery; d != nil {
+		// The discovery is created without an API client, only to
+		// validate its settings.
+		if _, err := newZoneDiscovery(nil, d.AccountID, d.NamePattern, d.NameRegex, d.Plans, time.Duration(d.RefreshInterval)); err != nil {
+			return fmt.Errorf("zone discovery: %w", err)
+		}
+	}
+
+	if _, err := cfg.collectorConfig(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// collectorConfig returns the collector settings described by the
+// configuration.
+func (cfg *config) collectorConfig() (collectorConfig, error) {
+	cc := collectorConfig{
+		logPeriod:      time.Duration(cfg.LogPeriod),
+		labelFields:    cfg.LabelFields,
+		latencyBuckets: cfg.LatencyBuckets,
+		sizeBuckets:    cfg.SizeBuckets,
+		metricFamilies: cfg.Metrics,
+		countryTopN:    cfg.CountryTopN,
+		routes:         cfg.Routes,
+		sampleRate:     cfg.SampleRate,
+		seriesTTL:      time.Duration(cfg.SeriesTTL),
+		endOffset:      time.Duration(cfg.EndOffset),
+		alignWindows:   cfg.AlignWindows,
+		timestamps:     cfg.Timestamps,
+		minuteBuckets:  cfg.MinuteBuckets,
+	}
+
+	switch cfg.WindowMode {
+	case "", "sliding":
+		cc.windowMode = windowSliding
+	case "contiguous":
+		cc.windowMode = windowContiguous
+	default:
+		return collectorConfig{}, errors.New("window mode must be either 'sliding' or 'contiguous'")
+	}
+
+	for _, family := range cfg.Metrics {
+		if _, ok := metricFamilies[family]; !ok {
+			return collectorConfig{}, fmt.Errorf("unknown metric family %q", family)
+		}
+	}
+
+	for _, fc := range cfg.Filters {
+		f, err := fc.filter()
+		if err != nil {
+			return collectorConfig{}, err
+		}
+		cc.filters = append(cc.filters, f)
+	}
+
+	return cc, nil
+}
+
+// watchConfig returns a channel which receives a value whenever the exporter
+// receives SIGHUP, or whenever the modification time or size of the file at
+// the given path changes, as checked once every interval.
+func watchConfig(path string, interval time.Duration) <-chan struct{} {
+	reload := make(chan struct{})
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		last := fileVersion(path)
+
+		for {
+			select {
+			case <-sighup:
+			case <-ticker.C:
+				current := fileVersion(path)
+				if current == last {
+					continue
+				}
+				last = current
+			}
+
+			reload <- struct{}{}
+		}
+	}()
+
+	return reload
+}
+
+// fileVersion returns a value which changes whenever the file at the given
+// path is modified. It follows symlinks, so that updates of mounted
+// Kubernetes ConfigMaps, which replace a symlink, are noticed.
+func fileVersion(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size())
+}
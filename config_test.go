@@ -0,0 +1,321 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	prommodel "github.com/prometheus/common/model"
+)
+
+// writeConfigFile writes the given contents into a configuration file in a
+// temporary directory, and returns its path.
+func writeConfigFile(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// setenv sets an environment variable for the duration of the given test.
+func setenv(t *testing.T, key, value string) {
+	prev, ok := os.LookupEnv(key)
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, prev)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+// TestLoadConfigFile checks that every setting of a configuration file is
+// read, and that defaults are applied to settings which are left out.
+func TestLoadConfigFile(t *testing.T) {
+	path := writeConfigFile(t, `
+credentials:
+  api_token:
+    env: TEST_API_TOKEN
+zones:
+  - name: example.org
+    filters:
+      - field: ClientRequestHost
+        regex: 'www\.example\.org'
+  - name: example.com
+log_period: 5m
+window_mode: contiguous
+metrics: [latency, cache]
+label_fields: [ClientRequestHost, ClientRequestMethod]
+latency_buckets: [0.1, 1]
+size_buckets: [1000]
+country_top_n: 10
+routes:
+  - /users/{id}
+filters:
+  - field: ClientRequestMethod
+    not_regex: OPTIONS
+rate_limit_requests: 15
+`)
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if cfg.ListenAddr != defaultListenAddr {
+		t.Errorf("expected default listen address, got %s", cfg.ListenAddr)
+	}
+
+	if len(cfg.Zones) != 2 || cfg.Zones[0].Name != "example.org" || len(cfg.Zones[0].Filters) != 1 {
+		t.Errorf("unexpected zones: %+v", cfg.Zones)
+	}
+
+	if cfg.MaxConcurrentPulls != defaultMaxConcurrentPulls || cfg.RateLimitRequests != 15 || cfg.RateLimitWindow != defaultRateLimitWindow {
+		t.Errorf("unexpected limits: %d concurrent, %d per %s", cfg.MaxConcurrentPulls, cfg.RateLimitRequests, cfg.RateLimitWindow)
+	}
+
+	cc, err := cfg.collectorConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if cc.logPeriod != 5*time.Minute || cc.windowMode != windowContiguous || cc.countryTopN != 10 {
+		t.Errorf("unexpected collector config: %+v", cc)
+	}
+
+	if !reflect.DeepEqual(cc.labelFields, []string{"ClientRequestHost", "ClientRequestMethod"}) {
+		t.Errorf("unexpected label fields: %v", cc.labelFields)
+	}
+
+	if !reflect.DeepEqual(cc.metricFamilies, []string{"latency", "cache"}) {
+		t.Errorf("unexpected metric families: %v", cc.metricFamilies)
+	}
+
+	if len(cc.filters) != 1 || !cc.filters[0].negate {
+		t.Errorf("unexpected filters: %+v", cc.filters)
+	}
+}
+
+// TestLoadConfigFileErrors checks that invalid configuration files are
+// rejected.
+func TestLoadConfigFileErrors(t *testing.T) {
+	testCases := map[string]string{
+		"unknown key": `
+credentials: {api_token: {env: TOKEN}}
+zones: [{name: example.org}]
+unknown: true
+`,
+		"no credentials": `
+zones: [{name: example.org}]
+`,
+		"two credentials": `
+credentials: {api_token: {env: TOKEN}, api_user_service_key: {env: KEY}}
+zones: [{name: example.org}]
+`,
+		"api key without email": `
+credentials: {api_key: {env: KEY}}
+zones: [{name: example.org}]
+`,
+		"no zones": `
+credentials: {api_token: {env: TOKEN}}
+`,
+		"zone without name or id": `
+credentials: {api_token: {env: TOKEN}}
+zones: [{filters: [{field: ClientRequestHost, regex: example}]}]
+`,
+		"invalid zone id": `
+credentials: {api_token: {env: TOKEN}}
+zones: [{id: example.org}]
+`,
+		"duplicate zone name": `
+credentials: {api_token: {env: TOKEN}}
+zones: [{name: example.org}, {name: example.org, sample_rate: 0.5}]
+`,
+		"duplicate zone id": `
+credentials: {api_token: {env: TOKEN}}
+zones: [{id: 0123456789abcdef0123456789abcdef}, {name: example.org, id: 0123456789abcdef0123456789abcdef}]
+`,
+		"negative concurrency": `
+credentials: {api_token: {env: TOKEN}}
+zones: [{name: example.org}]
+max_concurrent_pulls: -1
+`,
+		"rate limit without window": `
+credentials: {api_token: {env: TOKEN}}
+zones: [{name: example.org}]
+rate_limit_requests: 15
+rate_limit_window: 0s
+`,
+		"invalid zone sample rate": `
+credentials: {api_token: {env: TOKEN}}
+zones: [{name: example.org, sample_rate: 2}]
+`,
+		"unknown metric family": `
+credentials: {api_token: {env: TOKEN}}
+zones: [{name: example.org}]
+metrics: [errors]
+`,
+		"invalid window mode": `
+credentials: {api_token: {env: TOKEN}}
+zones: [{name: example.org}]
+window_mode: tumbling
+`,
+		"invalid filter": `
+credentials: {api_token: {env: TOKEN}}
+zones: [{name: example.org}]
+filters: [{field: ClientRequestHost}]
+`,
+		"invalid discovery": `
+credentials: {api_token: {env: TOKEN}}
+discovery: {name_pattern: "*.example.org", name_regex: example}
+`,
+		"invalid zone filter": `
+credentials: {api_token: {env: TOKEN}}
+zones: [{name: example.org, filters: [{field: ClientRequestHost, regex: "("}]}]
+`,
+	}
+
+	for condition, contents := range testCases {
+		if _, err := loadConfig(writeConfigFile(t, contents)); err == nil {
+			t.Errorf("expected error with %s", condition)
+		}
+	}
+}
+
+// TestLoadConfigFileDiscovery checks that zones need not be listed when zone
+// discovery is enabled, and that its refresh interval has a default.
+func TestLoadConfigFileDiscovery(t *testing.T) {
+	path := writeConfigFile(t, `
+credentials: {api_token: {env: TOKEN}}
+discovery:
+  account_id: account
+  name_pattern: "*.example.org"
+  plans: [enterprise]
+`)
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := &discoveryConfig{
+		AccountID:       "account",
+		NamePattern:     "*.example.org",
+		Plans:           []string{"enterprise"},
+		RefreshInterval: defaultDiscoveryInterval,
+	}
+
+	if !reflect.DeepEqual(cfg.Discovery, expected) {
+		t.Errorf("expected discovery %+v, got %+v", expected, cfg.Discovery)
+	}
+}
+
+// TestConfigFromEnv checks that the configuration is read from environment
+// variables when no configuration file is given.
+func TestConfigFromEnv(t *testing.T) {
+	setenv(t, "CLOUDFLARE_API_TOKEN", "token")
+	setenv(t, "CLOUDFLARE_ZONE_NAMES", "example.org, example.com")
+	setenv(t, "CLOUDFLARE_ZONE_IDS", "0123456789abcdef0123456789abcdef")
+	setenv(t, "EXPORTER_LATENCY_BUCKETS", "0.5,1")
+	setenv(t, "EXPORTER_METRICS", "bandwidth, firewall")
+	setenv(t, "EXPORTER_ROUTES", "/users/{id} /static=~^/(css|js)/")
+	setenv(t, "EXPORTER_SERIES_TTL", "1h")
+	setenv(t, "EXPORTER_LOG_PERIOD", "10m")
+	setenv(t, "EXPORTER_END_OFFSET", "5m")
+	setenv(t, "EXPORTER_ALIGN_WINDOWS", "true")
+	setenv(t, "EXPORTER_TIMESTAMPS", "true")
+	setenv(t, "EXPORTER_MINUTE_BUCKETS", "true")
+
+	cfg, err := loadConfig("")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if cfg.Credentials.APIToken.Env != "CLOUDFLARE_API_TOKEN" {
+		t.Errorf("expected API token to reference CLOUDFLARE_API_TOKEN, got %+v", cfg.Credentials.APIToken)
+	}
+
+	if len(cfg.Zones) != 3 || cfg.Zones[1].Name != "example.com" || cfg.Zones[2].ID != "0123456789abcdef0123456789abcdef" {
+		t.Errorf("unexpected zones: %+v", cfg.Zones)
+	}
+
+	if !reflect.DeepEqual(cfg.LatencyBuckets, []float64{0.5, 1}) {
+		t.Errorf("unexpected latency buckets: %v", cfg.LatencyBuckets)
+	}
+
+	if !reflect.DeepEqual(cfg.Metrics, []string{"bandwidth", "firewall"}) {
+		t.Errorf("unexpected metrics: %v", cfg.Metrics)
+	}
+
+	if !reflect.DeepEqual(cfg.Routes, []string{"/users/{id}", "/static=~^/(css|js)/"}) {
+		t.Errorf("unexpected routes: %v", cfg.Routes)
+	}
+
+	if cfg.SeriesTTL != prommodel.Duration(time.Hour) {
+		t.Errorf("unexpected series TTL: %s", cfg.SeriesTTL)
+	}
+
+	if cfg.LogPeriod != prommodel.Duration(10*time.Minute) || cfg.EndOffset != prommodel.Duration(5*time.Minute) || !cfg.AlignWindows || !cfg.Timestamps || !cfg.MinuteBuckets {
+		t.Errorf("unexpected windows: log period %s, end offset %s, aligned %t, timestamps %t, minute buckets %t", cfg.LogPeriod, cfg.EndOffset, cfg.AlignWindows, cfg.Timestamps, cfg.MinuteBuckets)
+	}
+}
+
+// TestSecretRef checks that secrets are resolved from environment variables
+// and files.
+func TestSecretRef(t *testing.T) {
+	setenv(t, "TEST_SECRET", "from-env")
+	path := writeConfigFile(t, "from-file\n")
+
+	if secret, err := (secretRef{Env: "TEST_SECRET"}).resolve(); err != nil || secret != "from-env" {
+		t.Errorf("expected from-env, got %q (error: %v)", secret, err)
+	}
+
+	if secret, err := (secretRef{File: path}).resolve(); err != nil || secret != "from-file" {
+		t.Errorf("expected from-file, got %q (error: %v)", secret, err)
+	}
+
+	for _, ref := range []secretRef{
+		{Env: "TEST_SECRET_UNSET"},
+		{File: path + ".missing"},
+		{Env: "TEST_SECRET", File: path},
+	} {
+		if _, err := ref.resolve(); err == nil {
+			t.Errorf("expected error resolving %+v", ref)
+		}
+	}
+}
+
+// TestWatchConfig checks that a reload is signalled when the configuration
+// file changes.
+func TestWatchConfig(t *testing.T) {
+	path := writeConfigFile(t, "a")
+	reload := watchConfig(path, 10*time.Millisecond)
+
+	select {
+	case <-reload:
+		t.Fatal("unexpected reload before the file changed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := ioutil.WriteFile(path, []byte("ab"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-reload:
+	case <-time.After(time.Second):
+		t.Error("expected reload after the file changed")
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+)
+
+// discoveryPageSize is the number of zones requested per page when listing
+// zones. It is the maximum allowed by the Cloudflare API.
+const discoveryPageSize = 50
+
+// zoneDiscovery lists the zones accessible through the Cloudflare API, and
+// selects those which match its criteria.
+type zoneDiscovery struct {
+	api       *cloudflare.API
+	accountID string
+	// matchName reports whether a zone with the given name is selected.
+	matchName func(string) bool
+	// plans, if not empty, are the lowercased plans of which a zone must
+	// have one to be selected.
+	plans []string
+	// interval is how often zones are discovered.
+	interval time.Duration
+}
+
+// newZoneDiscovery creates a new zoneDiscovery. Zones are selected if they
+// belong to the account with the given ID, have a name matching either the
+// glob pattern or the regular expression, and have one of the given plans.
+// Any of these criteria which are empty are ignored. Returns an error if any
+// parameters are invalid.
+func newZoneDiscovery(api *cloudflare.API, accountID, namePattern, nameRegex string, plans []string, interval time.Duration) (*zoneDiscovery, error) {
+	if namePattern != "" && nameRegex != "" {
+		return nil, errors.New("invalid parameter: only one of a name pattern or name regex may be set")
+	}
+
+	if interval <= 0 {
+		return nil, errors.New("invalid parameter: discovery interval must be positive")
+	}
+
+	matchName := func(string) bool { return true }
+
+	switch {
+	case namePattern != "":
+		if _, err := path.Match(namePattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid zone name pattern %q: %w", namePattern, err)
+		}
+		matchName = func(name string) bool {
+			matched, _ := path.Match(namePattern, name)
+			return matched
+		}
+	case nameRegex != "":
+		re, err := regexp.Compile("^(?:" + nameRegex + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid zone name regex %q: %w", nameRegex, err)
+		}
+		matchName = re.MatchString
+	}
+
+	lowerPlans := make([]string, 0, len(plans))
+	for _, plan := range plans {
+		lowerPlans = append(lowerPlans, strings.ToLower(plan))
+	}
+
+	return &zoneDiscovery{
+		api:       api,
+		accountID: accountID,
+		matchName: matchName,
+		plans:     lowerPlans,
+		interval:  interval,
+	}, nil
+}
+
+// matchPlan reports whether the given plan is one of the selected plans. A
+// plan is matched by either its legacy ID, such as "enterprise", or its name,
+// such as "Enterprise Website".
+func (d *zoneDiscovery) matchPlan(plan cloudflare.ZonePlan) bool {
+	if len(d.plans) == 0 {
+		return true
+	}
+
+	for _, p := range d.plans {
+		if p == strings.ToLower(plan.LegacyID) || p == strings.ToLower(plan.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// discover lists the active zones accessible through the Cloudflare API, and
+// returns those which match the criteria of the zoneDiscovery.
+func (d *zoneDiscovery) discover(ctx context.Context) ([]zone, error) {
+	var zones []zone
+
+	for page := 1; ; page++ {
+		resp, err := d.api.ListZonesContext(ctx,
+			cloudflare.WithZoneFilters("", d.accountID, "active"),
+			cloudflare.WithPagination(cloudflare.PaginationOptions{Page: page, PerPage: discoveryPageSize}),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("listing zones: %w", err)
+		}
+
+		for _, cz := range resp.Result {
+			if d.matchName(cz.Name) && d.matchPlan(cz.Plan) {
+				zones = append(zones, zone{id: cz.ID, name: cz.Name})
+			}
+		}
+
+		if page >= resp.TotalPages {
+			break
+		}
+	}
+
+	return zones, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+)
+
+// TestZoneDiscovery checks that zones are discovered across every page of
+// results, and that they are selected by name and plan.
+func TestZoneDiscovery(t *testing.T) {
+	pages := [][]string{
+		{
+			`{"id": "1", "name": "example.org", "plan": {"legacy_id": "enterprise", "name": "Enterprise Website"}}`,
+			`{"id": "2", "name": "example.com", "plan": {"legacy_id": "enterprise", "name": "Enterprise Website"}}`,
+		},
+		{
+			`{"id": "3", "name": "staging.example.org", "plan": {"legacy_id": "free", "name": "Free Website"}}`,
+			`{"id": "4", "name": "www.example.org", "plan": {"legacy_id": "enterprise", "name": "Enterprise Website"}}`,
+		},
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("account.id") != "account" || q.Get("status") != "active" {
+			t.Errorf("unexpected query: %s", r.URL.RawQuery)
+		}
+
+		page, _ := strconv.Atoi(q.Get("page"))
+		if page < 1 || page > len(pages) {
+			t.Errorf("unexpected page: %d", page)
+			return
+		}
+
+		result := "[" + pages[page-1][0] + "," + pages[page-1][1] + "]"
+		fmt.Fprintf(w, `{"success": true, "result": %s, "result_info": {"page": %d, "total_pages": %d}}`, result, page, len(pages))
+	}))
+	defer ts.Close()
+
+	cfapi, err := cloudflare.New("key", "email", cloudflare.HTTPClient(ts.Client()), cloudflare.UsingRateLimit(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfapi.BaseURL = ts.URL
+
+	testCases := []struct {
+		namePattern, nameRegex string
+		plans                  []string
+		expected               []string
+	}{
+		{expected: []string{"1", "2", "3", "4"}},
+		{namePattern: "*.example.org", expected: []string{"3", "4"}},
+		{nameRegex: `example\.(org|com)`, expected: []string{"1", "2"}},
+		{plans: []string{"Enterprise"}, expected: []string{"1", "2", "4"}},
+		{plans: []string{"free website"}, expected: []string{"3"}},
+	}
+
+	for _, tc := range testCases {
+		d, err := newZoneDiscovery(cfapi, "account", tc.namePattern, tc.nameRegex, tc.plans, time.Minute)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		zones, err := d.discover(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		var ids []string
+		for _, z := range zones {
+			ids = append(ids, z.id)
+		}
+
+		if !reflect.DeepEqual(ids, tc.expected) {
+			t.Errorf("expected zones %v with %+v, got %v", tc.expected, tc, ids)
+		}
+	}
+}
+
+// TestInvalidZoneDiscovery checks that invalid discovery settings are rejected.
+func TestInvalidZoneDiscovery(t *testing.T) {
+	testCases := map[string]struct {
+		namePattern, nameRegex string
+		interval               time.Duration
+	}{
+		"pattern and regex": {"*.example.org", "example", time.Minute},
+		"invalid pattern":   {"[", "", time.Minute},
+		"invalid regex":     {"", "(", time.Minute},
+		"zero interval":     {"", "", 0},
+	}
+
+	for condition, tc := range testCases {
+		if _, err := newZoneDiscovery(nil, "", tc.namePattern, tc.nameRegex, nil, tc.interval); err == nil {
+			t.Errorf("expected error with %s", condition)
+		}
+	}
+}
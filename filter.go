@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// fieldFilter selects log entries by the value of one of their fields. Only
+// log entries selected by every filter which applies to a zone are used to
+// derive metrics.
+type fieldFilter struct {
+	field   string
+	pattern *regexp.Regexp
+	// negate specifies that entries are selected if their value does not
+	// match pattern, rather than if it does.
+	negate bool
+}
+
+// newFieldFilter creates a fieldFilter on the given field. Like Prometheus
+// label matchers, the regular expression must match the whole value of the
+// field, which is formatted as by logEntry.labelValue.
+func newFieldFilter(field, expr string, negate bool) (fieldFilter, error) {
+	if !logpullFieldRegexp.MatchString(field) {
+		return fieldFilter{}, fmt.Errorf("invalid field name %q", field)
+	}
+
+	pattern, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return fieldFilter{}, fmt.Errorf("field %s: %w", field, err)
+	}
+
+	return fieldFilter{field, pattern, negate}, nil
+}
+
+// selects reports whether the filter selects the given log entry.
+func (f fieldFilter) selects(entry logEntry) bool {
+	return f.pattern.MatchString(entry.labelValue(f.field)) != f.negate
+}
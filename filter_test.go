@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+)
+
+// TestFieldFilter checks that filters match the whole value of a field, and
+// that negated filters select the entries which do not match.
+func TestFieldFilter(t *testing.T) {
+	entry := logEntry{"ClientRequestHost": "www.example.org"}
+
+	testCases := []struct {
+		expr     string
+		negate   bool
+		expected bool
+	}{
+		{`www\.example\.org`, false, true},
+		{`.*\.example\.org`, false, true},
+		{`example\.org`, false, false},
+		{`www|api`, false, false},
+		{`example\.org`, true, true},
+		{`www\.example\.org`, true, false},
+	}
+
+	for _, c := range testCases {
+		f, err := newFieldFilter("ClientRequestHost", c.expr, c.negate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := f.selects(entry); got != c.expected {
+			t.Errorf("%q (negate: %v): expected %v, got %v", c.expr, c.negate, c.expected, got)
+		}
+	}
+}
+
+// TestInvalidFieldFilter checks that filters with invalid field names or
+// regular expressions are rejected.
+func TestInvalidFieldFilter(t *testing.T) {
+	if _, err := newFieldFilter("client-request-host", ".*", false); err == nil {
+		t.Error("expected error with invalid field name")
+	}
+
+	if _, err := newFieldFilter("ClientRequestHost", "(", false); err == nil {
+		t.Error("expected error with invalid regular expression")
+	}
+}
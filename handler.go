@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// defaultScrapeTimeout is the scrape timeout assumed for scrapes which do not
+// specify one. It is the default scrape timeout of Prometheus.
+const defaultScrapeTimeout = 10 * time.Second
+
+// scrapeTimeoutMargin is the part of the scrape timeout which is left for
+// gathering and sending metrics.
+const scrapeTimeoutMargin = 500 * time.Millisecond
+
+// readyHandler wraps the given handler of scrapes, so that scrapes which
+// arrive before the first pull of the active collector, held by active as a
+// *collector, has completed wait for it, rather than being served no metrics.
+// Scrapes never wait beyond their timeout, which Prometheus sends in the
+// X-Prometheus-Scrape-Timeout-Seconds header.
+func readyHandler(active *atomic.Value, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), scrapeTimeout(r)-scrapeTimeoutMargin)
+		defer cancel()
+
+		active.Load().(*collector).waitReady(ctx)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// scrapeTimeout returns the timeout of the given scrape, or
+// defaultScrapeTimeout if it does not specify a valid one.
+func scrapeTimeout(r *http.Request) time.Duration {
+	seconds, err := strconv.ParseFloat(r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"), 64)
+	if err != nil || seconds <= 0 {
+		return defaultScrapeTimeout
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
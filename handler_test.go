@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestReadyHandler checks that scrapes wait for the first pull of the active
+// collector, but never beyond their timeout.
+func TestReadyHandler(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	api := newLogpullAPI("", "")
+	api.setAPIProperties(ts.URL, ts.Client())
+
+	c, err := newCollector(api, []zone{{id: "zone"}}, collectorConfig{logPeriod: time.Minute}, func(err error) {
+		t.Errorf("unexpected error: %s", err)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var active atomic.Value
+	active.Store(c)
+
+	var served int32
+	h := readyHandler(&active, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&served, 1)
+	}))
+
+	// Before the first pull, a scrape waits for its timeout, less the
+	// margin, and is then served anyway.
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "0.6")
+
+	start := time.Now()
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Errorf("expected scrape to wait for about 100ms, waited %s", elapsed)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	}()
+
+	c.pull(context.Background())
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("expected scrape to be served once the first pull completed")
+	}
+
+	if n := atomic.LoadInt32(&served); n != 2 {
+		t.Errorf("expected 2 scrapes to be served, got %d", n)
+	}
+}
+
+// TestScrapeTimeout checks that scrape timeouts are read from the header sent
+// by Prometheus.
+func TestScrapeTimeout(t *testing.T) {
+	testCases := []struct {
+		header   string
+		expected time.Duration
+	}{
+		{"", defaultScrapeTimeout},
+		{"15", 15 * time.Second},
+		{"2.5", 2500 * time.Millisecond},
+		{"0", defaultScrapeTimeout},
+		{"soon", defaultScrapeTimeout},
+	}
+
+	for _, c := range testCases {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if c.header != "" {
+			req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", c.header)
+		}
+
+		if got := scrapeTimeout(req); got != c.expected {
+			t.Errorf("%q: expected %s, got %s", c.header, c.expected, got)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+// defaultMaxConcurrentPulls is the number of requests to the Logpull API which
+// may be in flight at once, unless another limit is configured.
+const defaultMaxConcurrentPulls = 4
+
+// requestLimiter bounds the number of concurrent requests to the Logpull API,
+// and the rate at which they are made. Cloudflare rate-limits the Logpull API
+// per account, so a single requestLimiter is shared by all zones.
+type requestLimiter struct {
+	// slots holds a value for every request in flight. It is nil if the
+	// number of concurrent requests is not limited.
+	slots chan struct{}
+	// budget is nil if the rate of requests is not limited.
+	budget *rate.Limiter
+
+	queued    prometheus.Gauge
+	throttled prometheus.Counter
+}
+
+// newRequestLimiter creates a new requestLimiter, which allows at most
+// concurrency requests at once, and at most requests requests per window,
+// with bursts of up to requests requests. A concurrency or number of requests
+// of zero is unlimited.
+func newRequestLimiter(concurrency, requests int, window time.Duration) *requestLimiter {
+	l := &requestLimiter{
+		queued: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "cloudflare_logs_pulls_queued",
+			Help: "The number of requests to the Logpull API waiting for the concurrency or rate limit",
+		}),
+		throttled: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "cloudflare_logs_pulls_throttled_total",
+			Help: "The number of requests to the Logpull API which were delayed by the rate limit",
+		}),
+	}
+
+	if concurrency > 0 {
+		l.slots = make(chan struct{}, concurrency)
+	}
+
+	if requests > 0 && window > 0 {
+		l.budget = rate.NewLimiter(rate.Every(window/time.Duration(requests)), requests)
+	}
+
+	return l
+}
+
+// acquire blocks until a request may be made within the limits, and returns
+// a function which must be called once the request has completed. Returns an
+// error if ctx is done first.
+func (l *requestLimiter) acquire(ctx context.Context) (release func(), err error) {
+	l.queued.Inc()
+	defer l.queued.Dec()
+
+	release = func() {
+		if l.slots != nil {
+			<-l.slots
+		}
+	}
+
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for concurrency limit: %w", ctx.Err())
+		}
+	}
+
+	if l.budget != nil {
+		reservation := l.budget.Reserve()
+		if delay := reservation.Delay(); delay > 0 {
+			l.throttled.Inc()
+
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				reservation.Cancel()
+				release()
+				return nil, fmt.Errorf("waiting for rate limit: %w", ctx.Err())
+			}
+		}
+	}
+
+	return release, nil
+}
+
+// describe sends the descriptors of the metrics of the requestLimiter to the
+// given channel.
+func (l *requestLimiter) describe(ch chan<- *prometheus.Desc) {
+	l.queued.Describe(ch)
+	l.throttled.Describe(ch)
+}
+
+// collect sends the metrics of the requestLimiter to the given channel.
+func (l *requestLimiter) collect(ch chan<- prometheus.Metric) {
+	l.queued.Collect(ch)
+	l.throttled.Collect(ch)
+}
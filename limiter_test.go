@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestRequestLimiterConcurrency checks that no more than the configured
+// number of requests to the Logpull API are in flight at once, however many
+// zones are pulled.
+func TestRequestLimiterConcurrency(t *testing.T) {
+	var inFlight, maxInFlight int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer ts.Close()
+
+	api := newLogpullAPI("", "")
+	api.setAPIProperties(ts.URL, ts.Client())
+	api.setLimits(2, 0, 0)
+
+	var zones []zone
+	for _, id := range []string{"a", "b", "c", "d", "e", "f"} {
+		zones = append(zones, zone{id: id})
+	}
+
+	c, err := newCollector(api, zones, collectorConfig{logPeriod: time.Minute}, func(err error) {
+		t.Errorf("unexpected error: %s", err)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	c.pull(context.Background())
+
+	if n := atomic.LoadInt32(&maxInFlight); n != 2 {
+		t.Errorf("expected at most 2 requests in flight, got %d", n)
+	}
+}
+
+// TestRequestLimiterBudget checks that requests beyond the budget are delayed
+// until the budget allows them, and counted as throttled.
+func TestRequestLimiterBudget(t *testing.T) {
+	l := newRequestLimiter(0, 2, 200*time.Millisecond)
+
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := l.acquire(context.Background())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			release()
+		}()
+	}
+	wg.Wait()
+
+	// The first two requests use up the burst, and the other two wait for
+	// one and two intervals of 100ms respectively.
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("expected requests to be delayed by the budget, took %s", elapsed)
+	}
+
+	expected := `
+		# HELP cloudflare_logs_pulls_queued The number of requests to the Logpull API waiting for the concurrency or rate limit
+		# TYPE cloudflare_logs_pulls_queued gauge
+		cloudflare_logs_pulls_queued 0
+		# HELP cloudflare_logs_pulls_throttled_total The number of requests to the Logpull API which were delayed by the rate limit
+		# TYPE cloudflare_logs_pulls_throttled_total counter
+		cloudflare_logs_pulls_throttled_total 2
+	`
+
+	c, err := newCollector(&logpullAPI{limiter: l}, nil, collectorConfig{logPeriod: time.Minute}, func(error) {})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected), "cloudflare_logs_pulls_queued", "cloudflare_logs_pulls_throttled_total"); err != nil {
+		t.Error(err)
+	}
+}
@@ -2,11 +2,19 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -14,6 +22,31 @@ import (
 // overridden by the client.
 const defaultBaseURL = "https://api.cloudflare.com/client/v4"
 
+// defaultRetryPolicy is the retryPolicy of new Logpull API clients. Its
+// deadline leaves time for a pull to finish within the default log period of
+// one minute.
+var defaultRetryPolicy = retryPolicy{
+	minBackoff: time.Second,
+	maxBackoff: 15 * time.Second,
+	deadline:   45 * time.Second,
+}
+
+// jitter randomizes retry backoffs. Unlike the global source of math/rand, it
+// is seeded, so that exporters which start together do not retry together.
+// A rand.Rand is not safe for concurrent use, so it is guarded by jitterMu.
+var (
+	jitterMu sync.Mutex
+	jitter   = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// errMissingNewline is the error of a Logpull API response which does not end
+// with a newline. Every log entry is terminated by a newline, so such a
+// response was cut off in the middle of an entry.
+var errMissingNewline = fmt.Errorf("response ends without a trailing newline: %w", io.ErrUnexpectedEOF)
+
+// logpullFieldRegexp matches valid Logpull field names.
+var logpullFieldRegexp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]*$`)
+
 // authType represents the various Cloudflare API authentication schemes
 type authType int
 
@@ -26,13 +59,64 @@ const (
 	authToken
 )
 
-// logEntry contains all of the fields we care about from Cloudflare Logpull
-// API response data. It is the target type of JSON unmarshaling and is safe to
-// use as a map key.
-type logEntry struct {
-	ClientRequestHost    string `json:"ClientRequestHost"`
-	EdgeResponseStatus   int    `json:"EdgeResponseStatus"`
-	OriginResponseStatus int    `json:"OriginResponseStatus"`
+// logEntry contains the fields of a single log entry from Cloudflare Logpull
+// API response data, keyed by field name. Only the fields requested from the
+// API are present. Numbers are decoded as json.Number so that they can be
+// formatted exactly as they were received.
+type logEntry map[string]interface{}
+
+// labelValue returns the value of the given field formatted as a Prometheus
+// label value. Fields which are absent or null are formatted as the empty
+// string.
+func (e logEntry) labelValue(field string) string {
+	switch v := e[field].(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		// Arrays and objects are formatted as compact JSON; since
+		// they were just decoded from JSON, this cannot fail.
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
+
+// number returns the value of the given numeric field, and whether the field
+// holds a number. Some fields, such as those of Bot Management, are only
+// populated for zones with the relevant products enabled, and are otherwise
+// absent or null; they are reported as not holding a number rather than
+// treated as errors. Numbers encoded as strings are also accepted.
+func (e logEntry) number(field string) (float64, bool) {
+	var s string
+	switch v := e[field].(type) {
+	case json.Number:
+		s = v.String()
+	case string:
+		s = v
+	default:
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	return v, err == nil
+}
+
+// strings returns the string elements of the given array field. Fields which
+// are absent, null or not arrays yield no elements, as do elements which are
+// not strings.
+func (e logEntry) strings(field string) []string {
+	elems, _ := e[field].([]interface{})
+	values := make([]string, 0, len(elems))
+	for _, elem := range elems {
+		if v, ok := elem.(string); ok {
+			values = append(values, v)
+		}
+	}
+	return values
 }
 
 // logpullAPI is a minimal Cloudflare API client to handle Cloudflare's Logpull
@@ -46,27 +130,77 @@ type logpullAPI struct {
 	apiEmail       string
 	apiToken       string
 	apiUserService string
+	retryPolicy    retryPolicy
+	limiter        *requestLimiter
+}
+
+// retryPolicy configures how failed requests to the Logpull API are retried.
+// Only transport errors, truncated responses, and responses with status 429
+// or 5xx, are retried; other errors, such as authentication failures or
+// disabled log retention, are permanent. The zero value disables retries.
+type retryPolicy struct {
+	// minBackoff and maxBackoff bound the exponential backoff between
+	// attempts, before jitter is applied.
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	// deadline bounds the time from the first attempt until the start of
+	// the last one. No retry is attempted which would start after it.
+	deadline time.Duration
+}
+
+// backoff returns how long to wait before retrying after the given number of
+// failed attempts. Half of the exponential backoff is randomized, so that
+// concurrent pulls which fail together do not retry together.
+func (p retryPolicy) backoff(attempts int) time.Duration {
+	backoff := p.maxBackoff
+	if attempts < 32 {
+		if b := p.minBackoff << uint(attempts-1); b > 0 && b < backoff {
+			backoff = b
+		}
+	}
+
+	jitterMu.Lock()
+	defer jitterMu.Unlock()
+	return backoff/2 + time.Duration(jitter.Int63n(int64(backoff/2)+1))
+}
+
+// parseRetryAfter parses the value of a Retry-After header, given either in
+// seconds or as an HTTP date. Returns zero if the value is empty or invalid.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+
+	return 0
 }
 
 // newLogpullAPI creates a new Logpull API client from an API key and email
 // address.
 func newLogpullAPI(key, email string) *logpullAPI {
 	return &logpullAPI{
-		httpClient: http.DefaultClient,
-		baseURL:    defaultBaseURL,
-		authType:   authKeyEmail,
-		apiKey:     key,
-		apiEmail:   email,
+		httpClient:  http.DefaultClient,
+		baseURL:     defaultBaseURL,
+		authType:    authKeyEmail,
+		apiKey:      key,
+		apiEmail:    email,
+		retryPolicy: defaultRetryPolicy,
+		limiter:     newRequestLimiter(defaultMaxConcurrentPulls, 0, 0),
 	}
 }
 
 // newLogpullAPIWithToken creates a new Logpull API client from an API token.
 func newLogpullAPIWithToken(token string) *logpullAPI {
 	return &logpullAPI{
-		httpClient: http.DefaultClient,
-		baseURL:    defaultBaseURL,
-		authType:   authToken,
-		apiToken:   token,
+		httpClient:  http.DefaultClient,
+		baseURL:     defaultBaseURL,
+		authType:    authToken,
+		apiToken:    token,
+		retryPolicy: defaultRetryPolicy,
+		limiter:     newRequestLimiter(defaultMaxConcurrentPulls, 0, 0),
 	}
 }
 
@@ -78,6 +212,8 @@ func newLogpullAPIWithUserServiceKey(key string) *logpullAPI {
 		baseURL:        defaultBaseURL,
 		authType:       authUserService,
 		apiUserService: key,
+		retryPolicy:    defaultRetryPolicy,
+		limiter:        newRequestLimiter(defaultMaxConcurrentPulls, 0, 0),
 	}
 }
 
@@ -97,29 +233,114 @@ func (api *logpullAPI) setAPIProperties(baseURL string, httpClient *http.Client)
 	api.httpClient = httpClient
 }
 
+// setLimits replaces the requestLimiter of the client, so that at most
+// concurrency requests are made at once, and at most requests requests per
+// window. A concurrency or number of requests of zero is unlimited.
+func (api *logpullAPI) setLimits(concurrency, requests int, window time.Duration) {
+	api.limiter = newRequestLimiter(concurrency, requests, window)
+}
+
 // logHandler is a function which is called by pullLogEntries for each parsed
 // log entry.
 type logHandler func(logEntry) error
 
-// pullLogEntries makes a request to Cloudflare's Logpull API, requesting log
-// entries for the given zoneID between the given start and end time. Each
-// entry is parsed into a logEntry struct and passed to the given logHandler.
-func (api *logpullAPI) pullLogEntries(zoneID string, start, end time.Time, handler logHandler) error {
-	// The API will only return the requested fields; thus, if we add or
-	// remove fields from the logEntry struct definition, we'll also want
-	// to make sure we update this list to ask the API for the same.
-	fields := []string{
-		"ClientRequestHost",
-		"EdgeResponseStatus",
-		"OriginResponseStatus",
-	}
+// pullStats describes the work done by pullLogEntries, across all attempts.
+type pullStats struct {
+	// entries is the number of log entries passed to the logHandler.
+	entries int64
+	// bytes is the number of bytes read from response bodies.
+	bytes int64
+}
+
+// add adds the work described by other to the pullStats.
+func (s *pullStats) add(other pullStats) {
+	s.entries += other.entries
+	s.bytes += other.bytes
+}
+
+// countingReader is an io.Reader which counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (cr countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	*cr.n += int64(n)
+	return n, err
+}
 
+// pullLogEntries makes a request to Cloudflare's Logpull API, requesting the
+// given fields of the log entries for the given zoneID between the given start
+// and end time. If sample is between 0 and 1, only that fraction of the log
+// entries is requested, chosen at random by the API. Each entry is parsed into
+// a logEntry and passed to the given logHandler. Every attempt waits for the
+// requestLimiter of the client, and failed requests are retried according to
+// the retryPolicy of the client, unless some of their log entries have
+// already been passed to the logHandler, which a retry would pass again.
+// Waiting, retrying and reading the response all stop once ctx is done. The
+// work done is returned along with any error.
+func (api *logpullAPI) pullLogEntries(ctx context.Context, zoneID string, start, end time.Time, fields []string, sample float64, handler logHandler) (pullStats, error) {
 	url := api.baseURL + "/zones/" + zoneID + "/logs/received"
 	url += "?start=" + start.Format(time.RFC3339)
 	url += "&end=" + end.Format(time.RFC3339)
 	url += "&fields=" + strings.Join(fields, ",")
+	// Timestamp fields, such as EdgeStartTimestamp, are requested in
+	// nanoseconds since the epoch, whatever the default of the API.
+	url += "&timestamps=unixnano"
+
+	if sample > 0 && sample < 1 {
+		url += "&sample=" + strconv.FormatFloat(sample, 'f', -1, 64)
+	}
+
+	deadline := time.Now().Add(api.retryPolicy.deadline)
+
+	var stats pullStats
+
+	for attempts := 1; ; attempts++ {
+		release, err := api.limiter.acquire(ctx)
+		if err != nil {
+			return stats, err
+		}
+		handled := stats.entries
+		err = api.requestLogEntries(ctx, url, handler, &stats)
+		release()
 
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+		var apiErr *apiError
+		if !errors.As(err, &apiErr) || !apiErr.class.retryable() || stats.entries > handled {
+			return stats, err
+		}
+
+		wait := apiErr.retryAfter
+		if wait == 0 {
+			wait = api.retryPolicy.backoff(attempts)
+		}
+
+		if time.Now().Add(wait).After(deadline) {
+			if attempts > 1 {
+				return stats, fmt.Errorf("giving up after %d attempts: %w", attempts, err)
+			}
+			return stats, err
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return stats, fmt.Errorf("waiting to retry after %s: %w", err, ctx.Err())
+		}
+	}
+}
+
+// requestLogEntries makes a single request to the given Logpull API URL, and
+// passes each parsed log entry to the given logHandler. Errors from the
+// request or the response are returned as an *apiError; a response which is
+// cut off, whether by a transport error or by a missing trailing newline, is
+// returned as errorClassTruncated, after its complete entries have been
+// passed to the logHandler. The work done is added to stats.
+func (api *logpullAPI) requestLogEntries(ctx context.Context, url string, handler logHandler, stats *pullStats) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return fmt.Errorf("creating api request: %w", err)
 	}
@@ -141,33 +362,49 @@ func (api *logpullAPI) pullLogEntries(zoneID string, start, end time.Time, handl
 
 	resp, err := api.httpClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("performing api request: %w", err)
+		class := errorClassTransport
+		if ctx.Err() != nil {
+			class = errorClassTimeout
+		}
+		return &apiError{class: class, err: fmt.Errorf("performing api request: %w", err)}
 	}
 
 	defer resp.Body.Close()
 
+	body := countingReader{r: resp.Body, n: &stats.bytes}
+
 	if resp.StatusCode != http.StatusOK {
-		respBody, err := ioutil.ReadAll(resp.Body)
+		respBody, err := ioutil.ReadAll(body)
 		if err != nil {
-			err = fmt.Errorf("reading api response body: %w", err)
-		} else {
-			err = fmt.Errorf("unexpected api response: %s: %s", resp.Status, respBody)
+			return &apiError{class: errorClassTransport, status: resp.StatusCode, err: fmt.Errorf("reading api response body: %w", err)}
 		}
-		return err
+		return newResponseError(resp.StatusCode, resp.Header, respBody)
 	}
 
-	scanner := bufio.NewScanner(resp.Body)
-	scanner.Split(bufio.ScanLines)
+	scanner := bufio.NewScanner(body)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if atEOF && len(data) > 0 && bytes.IndexByte(data, '\n') < 0 {
+			return 0, nil, errMissingNewline
+		}
+		return bufio.ScanLines(data, atEOF)
+	})
 
 	for scanner.Scan() {
 		var entry logEntry
-		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
-			return fmt.Errorf("json: %w", err)
+		decoder := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		decoder.UseNumber()
+		if err := decoder.Decode(&entry); err != nil {
+			return &apiError{class: errorClassDecode, status: resp.StatusCode, err: fmt.Errorf("json: %w", err)}
 		}
+		stats.entries++
 		if err := handler(entry); err != nil {
 			return fmt.Errorf("handler: %w", err)
 		}
 	}
 
+	if err := scanner.Err(); err != nil {
+		return &apiError{class: errorClassTruncated, status: resp.StatusCode, err: fmt.Errorf("reading api response body: %w", err)}
+	}
+
 	return nil
 }
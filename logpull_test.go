@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -31,8 +36,8 @@ var (
 	tooRecentEnd   = time.Date(2021, time.January, 1, 18, 0, 0, 0, time.UTC)
 	tooRecentStart = tooRecentEnd.Add(-1 * time.Minute)
 
-	logEntryJSON     = []byte(`{"ClientRequestHost": "example.org", "EdgeResponseStatus": 200, "OriginResponseStatus": 200}`)
-	expectedLogEntry = logEntry{ClientRequestHost: "example.org", EdgeResponseStatus: 200, OriginResponseStatus: 200}
+	logEntryJSON     = []byte(`{"ClientRequestHost": "example.org", "EdgeResponseStatus": 200, "OriginResponseStatus": 200}` + "\n")
+	expectedLogEntry = logEntry{"ClientRequestHost": "example.org", "EdgeResponseStatus": json.Number("200"), "OriginResponseStatus": json.Number("200")}
 
 	nopLogHandler = func(logEntry) error { return nil }
 )
@@ -123,8 +128,8 @@ func TestPullLogEntries(t *testing.T) {
 	api := newLogpullAPI(goodKey, goodEmail)
 	api.setAPIProperties(ts.URL, ts.Client())
 
-	if err := api.pullLogEntries(goodZoneID, goodStart, goodEnd, func(entry logEntry) error {
-		if entry != expectedLogEntry {
+	if _, err := api.pullLogEntries(context.Background(), goodZoneID, goodStart, goodEnd, defaultLabelFields, 1, func(entry logEntry) error {
+		if !reflect.DeepEqual(entry, expectedLogEntry) {
 			t.Error("parsed log entry did not match expected value")
 		}
 		return nil
@@ -169,7 +174,7 @@ func TestPullLogEntriesLiveEndpoint(t *testing.T) {
 	start := end.Add(-1 * time.Minute)
 
 	lpapi := newLogpullAPIWithToken(token)
-	err = lpapi.pullLogEntries(zoneID, start, end, nopLogHandler)
+	_, err = lpapi.pullLogEntries(context.Background(), zoneID, start, end, defaultLabelFields, 1, nopLogHandler)
 	if err != nil {
 		t.Error(err)
 	}
@@ -228,7 +233,7 @@ func TestPullLogEntriesErrors(t *testing.T) {
 			}
 			api.setAPIProperties(ts.URL, ts.Client())
 
-			err := api.pullLogEntries(c.zoneID, c.start, c.end, nopLogHandler)
+			_, err := api.pullLogEntries(context.Background(), c.zoneID, c.start, c.end, defaultLabelFields, 1, nopLogHandler)
 			if err == nil && c.isErrorExpected {
 				t.Errorf("expected error when called %s", c.condition)
 			} else if err != nil && !c.isErrorExpected {
@@ -255,9 +260,305 @@ func TestPullLogEntriesAPIErrorContext(t *testing.T) {
 
 	api := newLogpullAPI(goodKey, goodEmail)
 	api.setAPIProperties(ts.URL, ts.Client())
+	api.retryPolicy = retryPolicy{}
 
-	err := api.pullLogEntries(goodZoneID, goodStart, goodEnd, nopLogHandler)
+	_, err := api.pullLogEntries(context.Background(), goodZoneID, goodStart, goodEnd, defaultLabelFields, 1, nopLogHandler)
 	if err == nil || !strings.Contains(err.Error(), msg) {
 		t.Error("expected an error containing the response body from the server")
 	}
 }
+
+// TestPullLogEntriesRetries checks that requests failing with transport
+// errors, or with status 429 or 5xx, are retried until they succeed, and that
+// other errors are never retried.
+func TestPullLogEntriesRetries(t *testing.T) {
+	testCases := []struct {
+		condition        string
+		failures         []int
+		isErrorExpected  bool
+		expectedAttempts int32
+	}{
+		{"with server errors", []int{http.StatusInternalServerError, http.StatusBadGateway}, false, 3},
+		{"with rate limiting", []int{http.StatusTooManyRequests}, false, 2},
+		{"with a transport error", []int{0}, false, 2},
+		{"with an authentication error", []int{http.StatusUnauthorized}, true, 1},
+		{"with a forbidden zone", []int{http.StatusForbidden}, true, 1},
+		{"with log retention disabled", []int{http.StatusBadRequest}, true, 1},
+		{"past the deadline", []int{500, 500, 500, 500, 500, 500, 500, 500, 500, 500}, true, 0},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.condition, func(t *testing.T) {
+			var attempts int32
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt32(&attempts, 1)
+				if int(n) > len(c.failures) {
+					if _, err := w.Write(logEntryJSON); err != nil {
+						t.Error(err)
+					}
+					return
+				}
+
+				if status := c.failures[n-1]; status != 0 {
+					w.WriteHeader(status)
+					return
+				}
+
+				// Simulate a transport error by closing the
+				// connection without a response.
+				conn, _, err := w.(http.Hijacker).Hijack()
+				if err != nil {
+					t.Fatal(err)
+				}
+				conn.Close()
+			}))
+			defer ts.Close()
+
+			api := newLogpullAPI(goodKey, goodEmail)
+			api.setAPIProperties(ts.URL, ts.Client())
+			api.retryPolicy = retryPolicy{
+				minBackoff: 10 * time.Millisecond,
+				maxBackoff: 20 * time.Millisecond,
+				deadline:   100 * time.Millisecond,
+			}
+
+			var entries int
+			_, err := api.pullLogEntries(context.Background(), goodZoneID, goodStart, goodEnd, defaultLabelFields, 1, func(logEntry) error {
+				entries++
+				return nil
+			})
+
+			if err == nil && c.isErrorExpected {
+				t.Errorf("expected error when called %s", c.condition)
+			} else if err != nil && !c.isErrorExpected {
+				t.Errorf("unexpected error: %s", err)
+			}
+
+			if !c.isErrorExpected && entries != 1 {
+				t.Errorf("expected 1 log entry, got %d", entries)
+			}
+
+			if n := atomic.LoadInt32(&attempts); c.expectedAttempts != 0 && n != c.expectedAttempts {
+				t.Errorf("expected %d attempts, got %d", c.expectedAttempts, n)
+			}
+		})
+	}
+}
+
+// TestPullLogEntriesTruncated checks that responses which are cut off, either
+// by the connection closing or by a missing trailing newline, are reported as
+// truncated, and that they are only retried if none of their log entries had
+// been passed to the logHandler. Only the first attempt is cut off.
+func TestPullLogEntriesTruncated(t *testing.T) {
+	testCases := []struct {
+		condition        string
+		body             string
+		contentLength    int
+		isErrorExpected  bool
+		expectedEntries  int
+		expectedAttempts int32
+	}{
+		{"without a trailing newline", string(logEntryJSON) + `{"ClientRequestHost": "exa`, 0, true, 1, 1},
+		{"with the connection closed", string(logEntryJSON), 1000, true, 1, 1},
+		{"before the first log entry", `{"ClientRequestHost": "exa`, 0, false, 1, 2},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.condition, func(t *testing.T) {
+			var attempts int32
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body := []byte(c.body)
+				if atomic.AddInt32(&attempts, 1) > 1 {
+					body = logEntryJSON
+				} else if c.contentLength > 0 {
+					w.Header().Set("Content-Length", strconv.Itoa(c.contentLength))
+				}
+				if _, err := w.Write(body); err != nil {
+					t.Error(err)
+				}
+			}))
+			defer ts.Close()
+
+			api := newLogpullAPI(goodKey, goodEmail)
+			api.setAPIProperties(ts.URL, ts.Client())
+			api.retryPolicy = retryPolicy{
+				minBackoff: 10 * time.Millisecond,
+				maxBackoff: 10 * time.Millisecond,
+				deadline:   100 * time.Millisecond,
+			}
+
+			var entries int
+			_, err := api.pullLogEntries(context.Background(), goodZoneID, goodStart, goodEnd, defaultLabelFields, 1, func(logEntry) error {
+				entries++
+				return nil
+			})
+
+			if c.isErrorExpected {
+				if class := classifyError(err); class != errorClassTruncated {
+					t.Errorf("expected class %s, got %s: %v", errorClassTruncated, class, err)
+				}
+			} else if err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+
+			if entries != c.expectedEntries {
+				t.Errorf("expected %d log entries, got %d", c.expectedEntries, entries)
+			}
+
+			if n := atomic.LoadInt32(&attempts); n != c.expectedAttempts {
+				t.Errorf("expected %d attempts, got %d", c.expectedAttempts, n)
+			}
+		})
+	}
+}
+
+// TestPullLogEntriesRetryAfter checks that the delay requested through the
+// Retry-After header is honoured, and that no retry is attempted if the delay
+// would exceed the deadline.
+func TestPullLogEntriesRetryAfter(t *testing.T) {
+	var attempts int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer ts.Close()
+
+	api := newLogpullAPI(goodKey, goodEmail)
+	api.setAPIProperties(ts.URL, ts.Client())
+	api.retryPolicy = retryPolicy{
+		minBackoff: time.Millisecond,
+		maxBackoff: time.Millisecond,
+		deadline:   1500 * time.Millisecond,
+	}
+
+	start := time.Now()
+	if _, err := api.pullLogEntries(context.Background(), goodZoneID, goodStart, goodEnd, defaultLabelFields, 1, nopLogHandler); err == nil {
+		t.Error("expected error")
+	}
+
+	if n := atomic.LoadInt32(&attempts); n != 2 {
+		t.Errorf("expected 2 attempts, got %d", n)
+	}
+
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("expected to wait for at least 1s before retrying, waited %s", elapsed)
+	}
+}
+
+// TestParseRetryAfter checks that Retry-After headers are parsed in both of
+// their formats.
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2021, time.January, 1, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", 0},
+		{"30", 30 * time.Second},
+		{"-1", 0},
+		{"Fri, 01 Jan 2021 12:01:00 GMT", time.Minute},
+		{"Fri, 01 Jan 2021 11:59:00 GMT", 0},
+		{"soon", 0},
+	}
+
+	for _, c := range testCases {
+		if got := parseRetryAfter(c.value, now); got != c.expected {
+			t.Errorf("%q: expected %s, got %s", c.value, c.expected, got)
+		}
+	}
+}
+
+// TestPullLogEntriesFields checks that pullLogEntries requests exactly the
+// given fields from the API.
+func TestPullLogEntriesFields(t *testing.T) {
+	fields := []string{"ClientRequestHost", "CacheCacheStatus"}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.URL.Query().Get("fields"); got != "ClientRequestHost,CacheCacheStatus" {
+			t.Errorf("unexpected fields parameter: %s", got)
+		}
+	}))
+	defer ts.Close()
+
+	api := newLogpullAPI(goodKey, goodEmail)
+	api.setAPIProperties(ts.URL, ts.Client())
+
+	if _, err := api.pullLogEntries(context.Background(), goodZoneID, goodStart, goodEnd, fields, 1, nopLogHandler); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+// TestLogEntryLabelValue checks that log entry fields of every JSON type are
+// formatted as label values.
+func TestLogEntryLabelValue(t *testing.T) {
+	var entry logEntry
+	decoder := json.NewDecoder(strings.NewReader(`{"s": "example.org", "n": 200, "f": 0.5, "b": true, "z": null, "a": ["block", "allow"]}`))
+	decoder.UseNumber()
+	if err := decoder.Decode(&entry); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		field    string
+		expected string
+	}{
+		{"s", "example.org"},
+		{"n", "200"},
+		{"f", "0.5"},
+		{"b", "true"},
+		{"z", ""},
+		{"a", `["block","allow"]`},
+		{"missing", ""},
+	}
+
+	for _, c := range testCases {
+		if got := entry.labelValue(c.field); got != c.expected {
+			t.Errorf("field %s: expected %q, got %q", c.field, c.expected, got)
+		}
+	}
+}
+
+// TestLogEntryStrings checks that string elements are extracted from array
+// fields, and that other fields yield no elements.
+func TestLogEntryStrings(t *testing.T) {
+	var entry logEntry
+	if err := json.Unmarshal([]byte(`{"a": ["log", 1, "block"], "s": "block", "z": null}`), &entry); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := entry.strings("a"); !reflect.DeepEqual(got, []string{"log", "block"}) {
+		t.Errorf("expected [log block], got %v", got)
+	}
+
+	for _, field := range []string{"s", "z", "missing"} {
+		if got := entry.strings(field); len(got) != 0 {
+			t.Errorf("field %s: expected no elements, got %v", field, got)
+		}
+	}
+}
+
+// TestLogEntryNumber checks that numbers, including those encoded as strings,
+// are extracted from fields, and that absent, null and non-numeric fields are
+// reported as such rather than treated as errors.
+func TestLogEntryNumber(t *testing.T) {
+	var entry logEntry
+	decoder := json.NewDecoder(strings.NewReader(`{"n": 42, "s": "42", "z": null, "x": "abc", "a": [1]}`))
+	decoder.UseNumber()
+	if err := decoder.Decode(&entry); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, field := range []string{"n", "s"} {
+		if v, ok := entry.number(field); !ok || v != 42 {
+			t.Errorf("field %s: expected 42, got %v (ok: %v)", field, v, ok)
+		}
+	}
+
+	for _, field := range []string{"z", "x", "a", "missing"} {
+		if _, ok := entry.number(field); ok {
+			t.Errorf("field %s: expected no number", field)
+		}
+	}
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
-	"strings"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/cloudflare/cloudflare-go"
@@ -12,76 +16,242 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-func main() {
-	addr := os.Getenv("EXPORTER_LISTEN_ADDR")
-	if addr == "" {
-		addr = ":9299"
-	}
+// configPollInterval is how often the configuration file is checked for
+// changes.
+const configPollInterval = 10 * time.Second
+
+// shutdownTimeout is how long scrapes in progress are given to complete on
+// shutdown.
+const shutdownTimeout = 5 * time.Second
+
+// newCollectorFromConfig creates the API clients described by the given
+// configuration, a collector, and the zoneManager which keeps the zones of the
+// collector up to date. No requests are made to the Cloudflare API: the
+// configured zones are set on the collector unresolved, until they are
+// resolved by the zoneManager.
+func newCollectorFromConfig(cfg *config) (*collector, *zoneManager, error) {
+	creds := cfg.Credentials
 
-	apiEmail := os.Getenv("CLOUDFLARE_API_EMAIL")
-	apiKey := os.Getenv("CLOUDFLARE_API_KEY")
-	apiToken := os.Getenv("CLOUDFLARE_API_TOKEN")
-	apiUserServiceKey := os.Getenv("CLOUDFLARE_API_USER_SERVICE_KEY")
-	zoneNames := os.Getenv("CLOUDFLARE_ZONE_NAMES")
+	var cfapi *cloudflare.API
+	var lpapi *logpullAPI
 
-	numAuthSettings := 0
-	for _, v := range []string{apiToken, apiKey, apiUserServiceKey} {
-		if v != "" {
-			numAuthSettings++
+	switch {
+	case creds.APIToken.isSet():
+		token, err := creds.APIToken.resolve()
+		if err != nil {
+			return nil, nil, fmt.Errorf("api token: %w", err)
+		}
+		if cfapi, err = cloudflare.NewWithAPIToken(token); err != nil {
+			return nil, nil, fmt.Errorf("creating cfapi client: %w", err)
 		}
+		lpapi = newLogpullAPIWithToken(token)
+	case creds.APIKey.isSet():
+		key, err := creds.APIKey.resolve()
+		if err != nil {
+			return nil, nil, fmt.Errorf("api key: %w", err)
+		}
+		if cfapi, err = cloudflare.New(key, creds.APIEmail); err != nil {
+			return nil, nil, fmt.Errorf("creating cfapi client: %w", err)
+		}
+		lpapi = newLogpullAPI(key, creds.APIEmail)
+	default:
+		key, err := creds.APIUserServiceKey.resolve()
+		if err != nil {
+			return nil, nil, fmt.Errorf("api user service key: %w", err)
+		}
+		if cfapi, err = cloudflare.NewWithUserServiceKey(key); err != nil {
+			return nil, nil, fmt.Errorf("creating cfapi client: %w", err)
+		}
+		lpapi = newLogpullAPIWithUserServiceKey(key)
 	}
 
-	if numAuthSettings != 1 {
-		log.Fatal("Must specify exactly one of CLOUDFLARE_API_TOKEN, CLOUDFLARE_API_KEY or CLOUDFLARE_API_USER_SERVICE_KEY.")
+	lpapi.setLimits(cfg.MaxConcurrentPulls, cfg.RateLimitRequests, time.Duration(cfg.RateLimitWindow))
+
+	zones := make([]zone, 0, len(cfg.Zones))
+	for _, zc := range cfg.Zones {
+		z := zone{id: zc.ID, name: zc.Name, sampleRate: zc.SampleRate}
+		for _, fc := range zc.Filters {
+			f, err := fc.filter()
+			if err != nil {
+				return nil, nil, fmt.Errorf("zone %s: %w", zc.Name+zc.ID, err)
+			}
+			z.filters = append(z.filters, f)
+		}
+		zones = append(zones, z)
 	}
 
-	if apiKey != "" && apiEmail == "" {
-		log.Fatal("CLOUDFLARE_API_KEY specified without CLOUDFLARE_API_EMAIL. Both must be provided.")
+	var discovery *zoneDiscovery
+	if d := cfg.Discovery; d != nil {
+		var err error
+		discovery, err = newZoneDiscovery(cfapi, d.AccountID, d.NamePattern, d.NameRegex, d.Plans, time.Duration(d.RefreshInterval))
+		if err != nil {
+			return nil, nil, fmt.Errorf("creating zone discovery: %w", err)
+		}
 	}
 
-	if zoneNames == "" {
-		log.Fatal("A comma-separated list of zone names must be specified in CLOUDFLARE_ZONE_NAMES")
+	cc, err := cfg.collectorConfig()
+	if err != nil {
+		return nil, nil, err
 	}
 
-	var cfapi *cloudflare.API
-	var lpapi *logpullAPI
-	var err error
-
-	if apiToken != "" {
-		cfapi, err = cloudflare.NewWithAPIToken(apiToken)
-		lpapi = newLogpullAPIWithToken(apiToken)
-	} else if apiKey != "" {
-		cfapi, err = cloudflare.New(apiKey, apiEmail)
-		lpapi = newLogpullAPI(apiKey, apiEmail)
-	} else {
-		cfapi, err = cloudflare.NewWithUserServiceKey(apiUserServiceKey)
-		lpapi = newLogpullAPIWithUserServiceKey(apiUserServiceKey)
+	collectorErrorHandler := func(err error) {
+		log.Printf("collector: %s", err)
 	}
 
+	zoneManager := newZoneManager(cfapi, zones, discovery)
+
+	collector, err := newCollector(lpapi, zoneManager.zones(), cc, collectorErrorHandler)
 	if err != nil {
-		log.Fatalf("creating cfapi client: %s", err)
+		return nil, nil, fmt.Errorf("creating collector: %w", err)
 	}
 
-	zoneIDs := make([]string, 0)
-	for _, zoneName := range strings.Split(zoneNames, ",") {
-		id, err := cfapi.ZoneIDByName(strings.TrimSpace(zoneName))
-		if err != nil {
-			log.Fatalf("zone id lookup: %s", err)
-		}
-		zoneIDs = append(zoneIDs, id)
-	}
+	return collector, zoneManager, nil
+}
 
-	collectorErrorHandler := func(err error) {
-		log.Printf("collector: %s", err)
+// rebuild is the result of building a collector from a reloaded
+// configuration. generation tells apart the builds of successive reloads.
+type rebuild struct {
+	generation  int
+	cfg         *config
+	collector   *collector
+	zoneManager *zoneManager
+	err         error
+}
+
+// start runs the given collector and zoneManager until ctx is done.
+func start(ctx context.Context, collector *collector, zoneManager *zoneManager) {
+	go collector.run(ctx)
+	go zoneManager.run(ctx, collector)
+}
+
+// updateAndStart resolves and discovers the zones of the given collector once,
+// and then runs the collector and zoneManager until ctx is done.
+func updateAndStart(ctx context.Context, collector *collector, zoneManager *zoneManager) {
+	zoneManager.update(ctx, collector)
+	start(ctx, collector, zoneManager)
+}
+
+func main() {
+	configFile := os.Getenv("EXPORTER_CONFIG_FILE")
+
+	cfg, err := loadConfig(configFile)
+	if err != nil {
+		log.Fatalf("loading config: %s", err)
 	}
 
-	collector, err := newCollector(lpapi, zoneIDs, time.Minute, collectorErrorHandler)
+	// ctx is cancelled on shutdown, which cancels any pulls in progress.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	collector, zoneManager, err := newCollectorFromConfig(cfg)
 	if err != nil {
-		log.Fatalf("creating collector: %s", err)
+		log.Fatal(err)
 	}
 
+	// Zones are resolved and discovered in the background, so that a slow
+	// Cloudflare API holds up neither serving metrics nor shutdown. Scrapes
+	// wait for the first pull, which follows the first update of zones.
+	collectorCtx, stopCollector := context.WithCancel(ctx)
+	go updateAndStart(collectorCtx, collector, zoneManager)
+
+	var active atomic.Value
+	active.Store(collector)
+
 	prometheus.MustRegister(collector)
-	http.Handle("/metrics", promhttp.Handler())
-	log.Printf("Listening on %s", addr)
-	log.Fatal(http.ListenAndServe(addr, nil))
+	http.Handle("/metrics", readyHandler(&active, promhttp.Handler()))
+
+	server := &http.Server{Addr: cfg.ListenAddr}
+
+	go func() {
+		log.Printf("Listening on %s", cfg.ListenAddr)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
+
+	// Configuration read from environment variables cannot change while
+	// the process is running, so there is nothing to reload, and reload is
+	// left nil.
+	var reload <-chan struct{}
+	if configFile != "" {
+		reload = watchConfig(configFile, configPollInterval)
+	}
+
+	// On reload, a new collector is built from the new configuration and
+	// swapped in for the old one, which keeps serving metrics until then.
+	// The HTTP listener is never restarted. Building a collector resolves
+	// and discovers its zones through the Cloudflare API, so it is done in
+	// the background, where it cannot delay shutdown. If the configuration
+	// changes again in the meantime, only the most recent build is used.
+	rebuilt := make(chan rebuild)
+	generation := 0
+
+	for {
+		select {
+		case <-reload:
+			next, err := loadConfig(configFile)
+			if err != nil {
+				log.Printf("reloading config: %s", err)
+				continue
+			}
+
+			if next.ListenAddr != cfg.ListenAddr {
+				log.Printf("reloading config: listen_addr cannot be changed without a restart, still listening on %s", cfg.ListenAddr)
+			}
+
+			generation++
+			go func(gen int, next *config) {
+				c, m, err := newCollectorFromConfig(next)
+				if err == nil {
+					m.update(ctx, c)
+				}
+				select {
+				case rebuilt <- rebuild{gen, next, c, m, err}:
+				case <-ctx.Done():
+				}
+			}(generation, next)
+		case r := <-rebuilt:
+			if r.generation != generation {
+				continue
+			}
+
+			if r.err != nil {
+				log.Printf("reloading config: %s", r.err)
+				continue
+			}
+
+			prometheus.Unregister(collector)
+			if err := prometheus.Register(r.collector); err != nil {
+				log.Printf("reloading config: registering collector: %s", err)
+				prometheus.MustRegister(collector)
+				continue
+			}
+
+			// The old collector is stopped before its snapshots are
+			// handed over, so that none of its windows are missed.
+			stopCollector()
+			r.collector.inherit(collector)
+			collectorCtx, stopCollector = context.WithCancel(ctx)
+			start(collectorCtx, r.collector, r.zoneManager)
+
+			collector = r.collector
+			active.Store(collector)
+			r.cfg.ListenAddr = cfg.ListenAddr
+			cfg = r.cfg
+			log.Printf("Reloaded config from %s", configFile)
+		case sig := <-shutdown:
+			log.Printf("Received %s, shutting down", sig)
+			cancel()
+
+			shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancelShutdown()
+			if err := server.Shutdown(shutdownCtx); err != nil {
+				log.Printf("shutting down: %s", err)
+			}
+			return
+		}
+	}
 }
@@ -0,0 +1,612 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/prometheus/client_golang/prometheus"
+	prommodel "github.com/prometheus/common/model"
+)
+
+// defaultLabelFields are the Logpull fields which are used as labels of the
+// HTTP responses metric, unless others are configured.
+var defaultLabelFields = []string{
+	"ClientRequestHost",
+	"EdgeResponseStatus",
+	"OriginResponseStatus",
+}
+
+// defaultLatencyBuckets are the upper bounds, in seconds, of the buckets of
+// the latency histograms, unless others are configured.
+var defaultLatencyBuckets = prometheus.DefBuckets
+
+// botScoreBuckets are the upper bounds of the buckets of the bot score
+// histogram. Cloudflare considers a score of 1 to be automated, scores up
+// to 29 likely automated, and higher scores likely human.
+var botScoreBuckets = []float64{1, 10, 20, 29, 50, 75, 99}
+
+// hostLabel is the label used by every metric which is broken down by host.
+var hostLabel = fieldLabelName("ClientRequestHost")
+
+// statusLabel is the label used by every metric which is broken down by the
+// status of the response to the client.
+var statusLabel = fieldLabelName("EdgeResponseStatus")
+
+// cacheStatusLabel is the label used by every metric which is broken down by
+// cache status.
+const cacheStatusLabel = "cache_status"
+
+// actionLabel is the label used by every metric which is broken down by
+// firewall action.
+const actionLabel = "action"
+
+// securityLevelLabel is the label used by every metric which is broken down by
+// security level.
+var securityLevelLabel = fieldLabelName("SecurityLevel")
+
+// botScoreSourceLabel is the label used by every metric which is broken down
+// by the source of the bot score.
+const botScoreSourceLabel = "bot_score_source"
+
+// zoneLabels are the labels which every metric derived from log entries has,
+// after its own labels, identifying the zone of the log entries. They are
+// added when the metrics are collected, so aggregations do not hold them.
+var zoneLabels = []string{"zone_id", "zone_name"}
+
+// otherCountry is the country reported for responses to clients outside of
+// the top countries, when the number of countries is capped.
+const otherCountry = "other"
+
+// countryOverflow is how many countries beyond the top countries may be
+// admitted by a countryCap, as the top countries change over time. Once it is
+// used up, no further countries are admitted, so that the number of series
+// stays bounded however long the exporter runs.
+const countryOverflow = 5
+
+// metricFamilies are the optional groups of metrics derived from log entries,
+// by the name with which they are enabled, and the Logpull fields which are
+// requested, in addition to the configured label fields, when they are.
+var metricFamilies = map[string][]string{
+	"latency":   {"ClientRequestHost", "OriginResponseTime", "EdgeTimeToFirstByteMs"},
+	"bandwidth": {"ClientRequestHost", "EdgeResponseStatus", "EdgeResponseBytes", "ClientRequestBytes"},
+	"cache":     {"ClientRequestHost", "CacheCacheStatus", "CacheResponseBytes"},
+	"firewall":  {"ClientRequestHost", "WAFAction", "FirewallMatchesActions", "SecurityLevel"},
+	"bot":       {"ClientRequestHost", "BotScore", "BotScoreSrc"},
+}
+
+// fieldLabelName converts the name of a Logpull field into the equivalent
+// Prometheus label name, e.g. ClientRequestHost becomes client_request_host
+// and ClientIP becomes client_ip.
+func fieldLabelName(field string) string {
+	var b strings.Builder
+	runes := []rune(field)
+
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prev := runes[i-1]
+			nextIsLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if !unicode.IsUpper(prev) || nextIsLower {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+
+	return b.String()
+}
+
+// logMetrics describes the metrics which are derived from log entries, and
+// how each log entry contributes to them.
+type logMetrics struct {
+	windowMode     windowMode
+	constLabels    prometheus.Labels
+	valueType      prometheus.ValueType
+	labelFields    []string
+	latencyBuckets []float64
+	sizeBuckets    []float64
+	countryTopN    int
+	// families are the names of the enabled metricFamilies.
+	families []string
+	// routes is nil unless route rules are configured.
+	routes *routeNormalizer
+	// countryIndex is the index of the country label within the labels of
+	// the HTTP responses metric, if countryTopN is non-zero.
+	countryIndex int
+
+	responses *prometheus.Desc
+	// The metrics of each of the metricFamilies are nil unless the family
+	// is enabled.
+	originResponseTime  *prometheus.Desc
+	edgeTimeToFirstByte *prometheus.Desc
+	edgeResponseBytes   *prometheus.Desc
+	clientRequestBytes  *prometheus.Desc
+	cacheRequests       *prometheus.Desc
+	cacheResponseBytes  *prometheus.Desc
+	wafActions          *prometheus.Desc
+	firewallActions     *prometheus.Desc
+	botScore            *prometheus.Desc
+	// edgeResponseSize and clientRequestSize are nil unless the bandwidth
+	// metrics are enabled and size buckets are configured.
+	edgeResponseSize  *prometheus.Desc
+	clientRequestSize *prometheus.Desc
+}
+
+// newLogMetrics creates the metrics described by the given collector
+// configuration. Returns an error if any settings are invalid.
+func newLogMetrics(cfg collectorConfig) (*logMetrics, error) {
+	m := &logMetrics{
+		windowMode:     cfg.windowMode,
+		labelFields:    cfg.labelFields,
+		latencyBuckets: cfg.latencyBuckets,
+		sizeBuckets:    cfg.sizeBuckets,
+		countryTopN:    cfg.countryTopN,
+	}
+
+	switch cfg.windowMode {
+	case windowSliding:
+		// With minute buckets, each sample describes a single minute
+		// of the log period.
+		period := cfg.logPeriod
+		if cfg.minuteBuckets {
+			period = time.Minute
+		}
+		m.constLabels = prometheus.Labels{
+			"period": prommodel.Duration(period).String(),
+		}
+		m.valueType = prometheus.GaugeValue
+	case windowContiguous:
+		m.valueType = prometheus.CounterValue
+	default:
+		return nil, errors.New("invalid parameter: unknown windowMode")
+	}
+
+	if len(m.labelFields) == 0 {
+		m.labelFields = defaultLabelFields
+	}
+
+	if m.countryTopN < 0 {
+		return nil, errors.New("invalid parameter: countryTopN must not be negative")
+	}
+
+	if m.countryTopN > 0 {
+		m.countryIndex = -1
+		for i, field := range m.labelFields {
+			if field == "ClientCountry" {
+				m.countryIndex = i
+			}
+		}
+		if m.countryIndex == -1 {
+			m.countryIndex = len(m.labelFields)
+			m.labelFields = append(append([]string(nil), m.labelFields...), "ClientCountry")
+		}
+	}
+
+	responseLabels := make([]string, 0, len(m.labelFields))
+	seenFields := make(map[string]bool)
+	for _, field := range m.labelFields {
+		if !logpullFieldRegexp.MatchString(field) {
+			return nil, fmt.Errorf("invalid parameter: labelFields contains invalid field name %q", field)
+		}
+		if seenFields[field] {
+			return nil, fmt.Errorf("invalid parameter: labelFields contains duplicate field %q", field)
+		}
+		for _, label := range zoneLabels {
+			if fieldLabelName(field) == label {
+				return nil, fmt.Errorf("invalid parameter: labelFields contains field %q, whose label %s is reserved for the zone", field, label)
+			}
+		}
+		seenFields[field] = true
+		responseLabels = append(responseLabels, fieldLabelName(field))
+	}
+
+	if len(cfg.routes) > 0 {
+		routes, err := newRouteNormalizer(cfg.routes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid parameter: routes: %w", err)
+		}
+		m.routes = routes
+		responseLabels = append(responseLabels, routeLabel)
+	}
+
+	if len(m.latencyBuckets) == 0 {
+		m.latencyBuckets = defaultLatencyBuckets
+	}
+
+	if err := validateBuckets(m.latencyBuckets); err != nil {
+		return nil, fmt.Errorf("invalid parameter: latencyBuckets %w", err)
+	}
+
+	if err := validateBuckets(m.sizeBuckets); err != nil {
+		return nil, fmt.Errorf("invalid parameter: sizeBuckets %w", err)
+	}
+
+	enabled := make(map[string]bool, len(cfg.metricFamilies))
+	for _, family := range cfg.metricFamilies {
+		if _, ok := metricFamilies[family]; !ok {
+			return nil, fmt.Errorf("invalid parameter: metricFamilies contains unknown family %q", family)
+		}
+		if !enabled[family] {
+			enabled[family] = true
+			m.families = append(m.families, family)
+		}
+	}
+
+	m.responses = m.newValueDesc(
+		"cloudflare_logs_http_responses",
+		"Cloudflare HTTP responses, obtained via Logpull API",
+		responseLabels...,
+	)
+
+	if enabled["latency"] {
+		m.originResponseTime = m.newHistogramDesc(
+			"cloudflare_logs_origin_response_duration_seconds",
+			"Time taken by the origin to respond to Cloudflare, obtained via Logpull API",
+			hostLabel,
+		)
+
+		m.edgeTimeToFirstByte = m.newHistogramDesc(
+			"cloudflare_logs_edge_time_to_first_byte_seconds",
+			"Time taken by Cloudflare to send the first byte of a response to clients, obtained via Logpull API",
+			hostLabel,
+		)
+	}
+
+	if enabled["bandwidth"] {
+		m.edgeResponseBytes = m.newValueDesc(
+			"cloudflare_logs_edge_response_bytes",
+			"Bytes sent by Cloudflare to clients, obtained via Logpull API",
+			hostLabel, statusLabel,
+		)
+
+		m.clientRequestBytes = m.newValueDesc(
+			"cloudflare_logs_client_request_bytes",
+			"Bytes received by Cloudflare from clients, obtained via Logpull API",
+			hostLabel, statusLabel,
+		)
+	}
+
+	if enabled["bandwidth"] && len(m.sizeBuckets) > 0 {
+		m.edgeResponseSize = m.newHistogramDesc(
+			"cloudflare_logs_edge_response_size_bytes",
+			"Size of the responses sent by Cloudflare to clients, obtained via Logpull API",
+			hostLabel,
+		)
+
+		m.clientRequestSize = m.newHistogramDesc(
+			"cloudflare_logs_client_request_size_bytes",
+			"Size of the requests received by Cloudflare from clients, obtained via Logpull API",
+			hostLabel,
+		)
+	}
+
+	if enabled["cache"] {
+		m.cacheRequests = m.newValueDesc(
+			"cloudflare_logs_cache_requests",
+			"Cloudflare HTTP requests by cache status, obtained via Logpull API",
+			hostLabel, cacheStatusLabel,
+		)
+
+		m.cacheResponseBytes = m.newValueDesc(
+			"cloudflare_logs_cache_response_bytes",
+			"Bytes served by the Cloudflare cache by cache status, obtained via Logpull API",
+			hostLabel, cacheStatusLabel,
+		)
+	}
+
+	if enabled["firewall"] {
+		m.wafActions = m.newValueDesc(
+			"cloudflare_logs_waf_actions",
+			"Cloudflare HTTP requests by WAF action taken, obtained via Logpull API",
+			hostLabel, actionLabel,
+		)
+
+		m.firewallActions = m.newValueDesc(
+			"cloudflare_logs_firewall_actions",
+			"Cloudflare HTTP requests by firewall action taken and security level, obtained via Logpull API",
+			hostLabel, actionLabel, securityLevelLabel,
+		)
+	}
+
+	if enabled["bot"] {
+		m.botScore = m.newHistogramDesc(
+			"cloudflare_logs_bot_score",
+			"Bot Management scores of Cloudflare HTTP requests, obtained via Logpull API",
+			hostLabel, botScoreSourceLabel,
+		)
+	}
+
+	return m, nil
+}
+
+// validateBuckets returns an error unless the given histogram bucket upper
+// bounds are sorted in strictly increasing order.
+func validateBuckets(buckets []float64) error {
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i] <= buckets[i-1] {
+			return errors.New("must be in strictly increasing order")
+		}
+	}
+	return nil
+}
+
+// newValueDesc creates the Desc of a metric which counts log entries, or sums
+// one of their fields. In sliding mode, the metric is a gauge describing the
+// most recent logPeriod; in contiguous mode, it is a counter, and "_total" is
+// appended to its name. The zoneLabels follow the given labels.
+func (m *logMetrics) newValueDesc(name, help string, labels ...string) *prometheus.Desc {
+	if m.windowMode == windowContiguous {
+		name += "_total"
+	}
+	return prometheus.NewDesc(name, help, append(labels, zoneLabels...), m.constLabels)
+}
+
+// newHistogramDesc creates the Desc of a histogram of log entry fields. In
+// sliding mode, the histogram describes the most recent logPeriod alone. The
+// zoneLabels follow the given labels.
+func (m *logMetrics) newHistogramDesc(name, help string, labels ...string) *prometheus.Desc {
+	return prometheus.NewDesc(name, help, append(labels, zoneLabels...), m.constLabels)
+}
+
+// fields returns the Logpull fields which must be requested in order to
+// observe log entries.
+func (m *logMetrics) fields() []string {
+	set := make(map[string]bool)
+	for _, field := range m.labelFields {
+		set[field] = true
+	}
+	for _, family := range m.families {
+		for _, field := range metricFamilies[family] {
+			set[field] = true
+		}
+	}
+	if m.routes != nil {
+		set["ClientRequestURI"] = true
+	}
+
+	fields := make([]string, 0, len(set))
+	for field := range set {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// countryCap holds the state needed to cap the number of countries reported
+// by the HTTP responses metric of a single zone.
+type countryCap struct {
+	// totals holds the number of responses to each country.
+	totals map[string]float64
+	// admitted holds the countries which are reported by name.
+	admitted map[string]bool
+}
+
+// newCountryCap creates an empty countryCap.
+func newCountryCap() *countryCap {
+	return &countryCap{
+		totals:   make(map[string]float64),
+		admitted: make(map[string]bool),
+	}
+}
+
+// clone returns a deep copy of the countryCap.
+func (cc *countryCap) clone() *countryCap {
+	c := newCountryCap()
+	for country, total := range cc.totals {
+		c.totals[country] = total
+	}
+	for country := range cc.admitted {
+		c.admitted[country] = true
+	}
+	return c
+}
+
+// capCountries limits the countries reported by the HTTP responses metric in
+// the given aggregation to the countryTopN countries with the most responses
+// in cc, after adding those of the aggregation, and reports every other
+// country as otherCountry. Once admitted by cc, a country remains reported by
+// name, so that series of counters are never folded into otherCountry after
+// they have been reported. At most countryTopN plus countryOverflow countries
+// are ever admitted by cc. It does nothing unless countryTopN is non-zero.
+func (m *logMetrics) capCountries(a *aggregation, cc *countryCap) {
+	if m.countryTopN == 0 {
+		return
+	}
+
+	for key, v := range a.values {
+		if key.desc == m.responses {
+			cc.totals[key.labels.values()[m.countryIndex]] += v
+		}
+	}
+
+	countries := make([]string, 0, len(cc.totals))
+	for country := range cc.totals {
+		countries = append(countries, country)
+	}
+
+	sort.Slice(countries, func(i, j int) bool {
+		ti, tj := cc.totals[countries[i]], cc.totals[countries[j]]
+		if ti != tj {
+			return ti > tj
+		}
+		return countries[i] < countries[j]
+	})
+
+	for i := 0; i < len(countries) && i < m.countryTopN; i++ {
+		if len(cc.admitted) < m.countryTopN+countryOverflow {
+			cc.admitted[countries[i]] = true
+		}
+	}
+
+	a.relabel(m.responses, m.countryIndex, func(country string) string {
+		if cc.admitted[country] {
+			return country
+		}
+		return otherCountry
+	})
+}
+
+// descs returns the Desc of every metric, in a fixed order, with nil in place
+// of those which are not enabled.
+func (m *logMetrics) descs() []*prometheus.Desc {
+	return []*prometheus.Desc{
+		m.responses,
+		m.originResponseTime,
+		m.edgeTimeToFirstByte,
+		m.edgeResponseBytes,
+		m.clientRequestBytes,
+		m.edgeResponseSize,
+		m.clientRequestSize,
+		m.cacheRequests,
+		m.cacheResponseBytes,
+		m.wafActions,
+		m.firewallActions,
+		m.botScore,
+	}
+}
+
+// describe sends the Desc of every enabled metric to ch.
+func (m *logMetrics) describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range m.descs() {
+		if desc != nil {
+			ch <- desc
+		}
+	}
+}
+
+// translation returns a map from every Desc of old to the equivalent Desc of
+// m, if both describe the same metrics, with the same labels, value type and
+// histogram buckets, so that the series aggregated by old can be reported by
+// m. Otherwise, it returns nil.
+func (m *logMetrics) translation(old *logMetrics) map[*prometheus.Desc]*prometheus.Desc {
+	if m.valueType != old.valueType ||
+		!equalBuckets(m.latencyBuckets, old.latencyBuckets) ||
+		!equalBuckets(m.sizeBuckets, old.sizeBuckets) {
+		return nil
+	}
+
+	descs := make(map[*prometheus.Desc]*prometheus.Desc)
+	oldDescs := old.descs()
+	for i, desc := range m.descs() {
+		if (desc == nil) != (oldDescs[i] == nil) {
+			return nil
+		}
+		if desc == nil {
+			continue
+		}
+		if desc.String() != oldDescs[i].String() {
+			return nil
+		}
+		descs[oldDescs[i]] = desc
+	}
+
+	return descs
+}
+
+// equalBuckets reports whether two lists of histogram bucket upper bounds are
+// the same.
+func equalBuckets(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// observe adds the contribution of a single log entry, counted weight times,
+// to the given aggregation. Log entries pulled with a sample rate are weighted
+// by its inverse, so that the metrics estimate those of all log entries.
+func (m *logMetrics) observe(a *aggregation, entry logEntry, weight float64) {
+	values := make([]string, len(m.labelFields), len(m.labelFields)+1)
+	for i, field := range m.labelFields {
+		values[i] = entry.labelValue(field)
+	}
+	if m.routes != nil {
+		values = append(values, m.routes.route(entry.labelValue("ClientRequestURI")))
+	}
+	a.add(m.responses, newLabelSet(values...), weight)
+
+	host := newLabelSet(entry.labelValue("ClientRequestHost"))
+
+	if m.originResponseTime != nil {
+		// Responses served from cache never reach the origin, and are
+		// logged with an OriginResponseTime of zero.
+		if ns, ok := entry.number("OriginResponseTime"); ok && ns > 0 {
+			a.observe(m.originResponseTime, m.latencyBuckets, host, ns/1e9, weight)
+		}
+
+		if ms, ok := entry.number("EdgeTimeToFirstByteMs"); ok {
+			a.observe(m.edgeTimeToFirstByte, m.latencyBuckets, host, ms/1e3, weight)
+		}
+	}
+
+	if m.edgeResponseBytes != nil {
+		hostStatus := newLabelSet(entry.labelValue("ClientRequestHost"), entry.labelValue("EdgeResponseStatus"))
+
+		if bytes, ok := entry.number("EdgeResponseBytes"); ok {
+			a.add(m.edgeResponseBytes, hostStatus, bytes*weight)
+			if m.edgeResponseSize != nil {
+				a.observe(m.edgeResponseSize, m.sizeBuckets, host, bytes, weight)
+			}
+		}
+
+		if bytes, ok := entry.number("ClientRequestBytes"); ok {
+			a.add(m.clientRequestBytes, hostStatus, bytes*weight)
+			if m.clientRequestSize != nil {
+				a.observe(m.clientRequestSize, m.sizeBuckets, host, bytes, weight)
+			}
+		}
+	}
+
+	if m.cacheRequests != nil {
+		if cacheStatus := entry.labelValue("CacheCacheStatus"); cacheStatus != "" {
+			hostCacheStatus := newLabelSet(entry.labelValue("ClientRequestHost"), cacheStatus)
+			a.add(m.cacheRequests, hostCacheStatus, weight)
+			if bytes, ok := entry.number("CacheResponseBytes"); ok {
+				a.add(m.cacheResponseBytes, hostCacheStatus, bytes*weight)
+			}
+		}
+	}
+
+	if m.wafActions != nil {
+		// Requests which the WAF did not act upon are logged with an
+		// action of "unknown".
+		if action := entry.labelValue("WAFAction"); action != "" && action != "unknown" {
+			a.add(m.wafActions, newLabelSet(entry.labelValue("ClientRequestHost"), action), weight)
+		}
+
+		// FirewallMatchesActions holds the action of every firewall rule
+		// which matched the request, so the same action may appear more
+		// than once. Each distinct action is counted once per request.
+		seenActions := make(map[string]bool)
+		for _, action := range entry.strings("FirewallMatchesActions") {
+			if seenActions[action] {
+				continue
+			}
+			seenActions[action] = true
+			a.add(m.firewallActions, newLabelSet(
+				entry.labelValue("ClientRequestHost"),
+				action,
+				entry.labelValue("SecurityLevel"),
+			), weight)
+		}
+	}
+
+	if m.botScore != nil {
+		// Zones without Bot Management log no bot score, and requests
+		// which were not scored are logged with a score of zero.
+		if score, ok := entry.number("BotScore"); ok && score >= 1 {
+			a.observe(m.botScore, botScoreBuckets, newLabelSet(
+				entry.labelValue("ClientRequestHost"),
+				entry.labelValue("BotScoreSrc"),
+			), score, weight)
+		}
+	}
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestFieldLabelName checks the conversion of Logpull field names into
+// Prometheus label names.
+func TestFieldLabelName(t *testing.T) {
+	testCases := map[string]string{
+		"ClientRequestHost":     "client_request_host",
+		"ClientIP":              "client_ip",
+		"ClientRequestURI":      "client_request_uri",
+		"WAFAction":             "waf_action",
+		"EdgeTimeToFirstByteMs": "edge_time_to_first_byte_ms",
+		"ClientSSLProtocol":     "client_ssl_protocol",
+		"RayID":                 "ray_id",
+	}
+
+	for field, expected := range testCases {
+		if got := fieldLabelName(field); got != expected {
+			t.Errorf("%s: expected %s, got %s", field, expected, got)
+		}
+	}
+}
+
+// TestLatencyHistograms checks that the origin and edge latency histograms
+// are built from OriginResponseTime and EdgeTimeToFirstByteMs, and that
+// responses served from cache are left out of the origin histogram.
+func TestLatencyHistograms(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jsonBody := []byte(`{"ClientRequestHost": "example.org", "OriginResponseTime": 50000000, "EdgeTimeToFirstByteMs": 60}` + "\n" +
+			`{"ClientRequestHost": "example.org", "OriginResponseTime": 200000000, "EdgeTimeToFirstByteMs": 210}` + "\n" +
+			`{"ClientRequestHost": "example.org", "OriginResponseTime": 0, "EdgeTimeToFirstByteMs": 5}` + "\n")
+		if _, err := w.Write(jsonBody); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}))
+	defer ts.Close()
+
+	api := newLogpullAPI("", "")
+	api.setAPIProperties(ts.URL, ts.Client())
+
+	cfg := collectorConfig{
+		logPeriod:      time.Minute,
+		latencyBuckets: []float64{0.1, 1},
+		metricFamilies: []string{"latency"},
+	}
+	c, err := newCollector(api, []zone{{id: "zone"}}, cfg, func(err error) {
+		t.Errorf("unexpected error: %s", err)
+	})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	c.pull(context.Background())
+
+	expected := strings.NewReader(`
+		# HELP cloudflare_logs_edge_time_to_first_byte_seconds Time taken by Cloudflare to send the first byte of a response to clients, obtained via Logpull API
+		# TYPE cloudflare_logs_edge_time_to_first_byte_seconds histogram
+		cloudflare_logs_edge_time_to_first_byte_seconds_bucket{client_request_host="example.org",period="1m",zone_id="zone",zone_name="",le="0.1"} 2
+		cloudflare_logs_edge_time_to_first_byte_seconds_bucket{client_request_host="example.org",period="1m",zone_id="zone",zone_name="",le="1"} 3
+		cloudflare_logs_edge_time_to_first_byte_seconds_bucket{client_request_host="example.org",period="1m",zone_id="zone",zone_name="",le="+Inf"} 3
+		cloudflare_logs_edge_time_to_first_byte_seconds_sum{client_request_host="example.org",period="1m",zone_id="zone",zone_name=""} 0.275
+		cloudflare_logs_edge_time_to_first_byte_seconds_count{client_request_host="example.org",period="1m",zone_id="zone",zone_name=""} 3
+		# HELP cloudflare_logs_origin_response_duration_seconds Time taken by the origin to respond to Cloudflare, obtained via Logpull API
+		# TYPE cloudflare_logs_origin_response_duration_seconds histogram
+		cloudflare_logs_origin_response_duration_seconds_bucket{client_request_host="example.org",period="1m",zone_id="zone",zone_name="",le="0.1"} 1
+		cloudflare_logs_origin_response_duration_seconds_bucket{client_request_host="example.org",period="1m",zone_id="zone",zone_name="",le="1"} 2
+		cloudflare_logs_origin_response_duration_seconds_bucket{client_request_host="example.org",period="1m",zone_id="zone",zone_name="",le="+Inf"} 2
+		cloudflare_logs_origin_response_duration_seconds_sum{client_request_host="example.org",period="1m",zone_id="zone",zone_name=""} 0.25
+		cloudflare_logs_origin_response_duration_seconds_count{client_request_host="example.org",period="1m",zone_id="zone",zone_name=""} 2
+	`)
+
+	if err := testutil.CollectAndCompare(c, expected,
+		"cloudflare_logs_edge_time_to_first_byte_seconds",
+		"cloudflare_logs_origin_response_duration_seconds",
+	); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestInvalidLatencyBuckets checks that unsorted latency buckets are
+// rejected.
+func TestInvalidLatencyBuckets(t *testing.T) {
+	cfg := collectorConfig{logPeriod: time.Minute, latencyBuckets: []float64{1, 0.5}}
+	if _, err := newLogMetrics(cfg); err == nil {
+		t.Error("expected error with unsorted latency buckets")
+	}
+}
+
+// TestMetricFamilies checks that only the fields of the enabled metric
+// families are requested, and that unknown families are rejected.
+func TestMetricFamilies(t *testing.T) {
+	testCases := []struct {
+		families []string
+		expected []string
+	}{
+		{nil, []string{"ClientRequestHost", "EdgeResponseStatus", "OriginResponseStatus"}},
+		{[]string{"cache"}, []string{"CacheCacheStatus", "CacheResponseBytes", "ClientRequestHost", "EdgeResponseStatus", "OriginResponseStatus"}},
+		{[]string{"bot", "latency", "bot"}, []string{"BotScore", "BotScoreSrc", "ClientRequestHost", "EdgeResponseStatus", "EdgeTimeToFirstByteMs", "OriginResponseStatus", "OriginResponseTime"}},
+	}
+
+	for _, c := range testCases {
+		m, err := newLogMetrics(collectorConfig{logPeriod: time.Minute, metricFamilies: c.families})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if fields := m.fields(); !reflect.DeepEqual(fields, c.expected) {
+			t.Errorf("with families %v: expected fields %v, got %v", c.families, c.expected, fields)
+		}
+	}
+
+	if _, err := newLogMetrics(collectorConfig{logPeriod: time.Minute, metricFamilies: []string{"errors"}}); err == nil {
+		t.Error("expected error with an unknown metric family")
+	}
+}
+
+// TestCapCountriesOverflow checks that a countryCap stops admitting countries
+// once countryOverflow countries beyond the top countries have been admitted,
+// however often the top countries change.
+func TestCapCountriesOverflow(t *testing.T) {
+	m, err := newLogMetrics(collectorConfig{
+		logPeriod:   time.Minute,
+		windowMode:  windowContiguous,
+		labelFields: []string{"ClientCountry"},
+		countryTopN: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc := newCountryCap()
+
+	// Every window has a new country, with more responses than all of the
+	// previous countries together, so that it leads the ranking.
+	for i := 0; i < 20; i++ {
+		a := newAggregation()
+		a.add(m.responses, newLabelSet(fmt.Sprintf("c%d", i)), float64(int(1)<<uint(i)))
+		m.capCountries(a, cc)
+	}
+
+	if n := len(cc.admitted); n != 1+countryOverflow {
+		t.Errorf("expected %d admitted countries, got %d", 1+countryOverflow, n)
+	}
+}
+
+// TestBandwidthMetrics checks that request and response bytes are summed per
+// host and status, and that size histograms are only reported when size
+// buckets are configured.
+func TestBandwidthMetrics(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jsonBody := []byte(`{"ClientRequestHost": "example.org", "EdgeResponseStatus": 200, "EdgeResponseBytes": 1000, "ClientRequestBytes": 100}` + "\n" +
+			`{"ClientRequestHost": "example.org", "EdgeResponseStatus": 200, "EdgeResponseBytes": 3000, "ClientRequestBytes": 300}` + "\n" +
+			`{"ClientRequestHost": "example.org", "EdgeResponseStatus": 404, "EdgeResponseBytes": 500, "ClientRequestBytes": 200}` + "\n")
+		if _, err := w.Write(jsonBody); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}))
+	defer ts.Close()
+
+	api := newLogpullAPI("", "")
+	api.setAPIProperties(ts.URL, ts.Client())
+
+	cfg := collectorConfig{
+		logPeriod:      time.Minute,
+		windowMode:     windowContiguous,
+		sizeBuckets:    []float64{1000},
+		metricFamilies: []string{"bandwidth"},
+	}
+	c, err := newCollector(api, []zone{{id: "zone"}}, cfg, func(err error) {
+		t.Errorf("unexpected error: %s", err)
+	})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	c.pull(context.Background())
+
+	expected := strings.NewReader(`
+		# HELP cloudflare_logs_client_request_bytes_total Bytes received by Cloudflare from clients, obtained via Logpull API
+		# TYPE cloudflare_logs_client_request_bytes_total counter
+		cloudflare_logs_client_request_bytes_total{client_request_host="example.org",edge_response_status="200",zone_id="zone",zone_name=""} 400
+		cloudflare_logs_client_request_bytes_total{client_request_host="example.org",edge_response_status="404",zone_id="zone",zone_name=""} 200
+		# HELP cloudflare_logs_edge_response_bytes_total Bytes sent by Cloudflare to clients, obtained via Logpull API
+		# TYPE cloudflare_logs_edge_response_bytes_total counter
+		cloudflare_logs_edge_response_bytes_total{client_request_host="example.org",edge_response_status="200",zone_id="zone",zone_name=""} 4000
+		cloudflare_logs_edge_response_bytes_total{client_request_host="example.org",edge_response_status="404",zone_id="zone",zone_name=""} 500
+		# HELP cloudflare_logs_edge_response_size_bytes Size of the responses sent by Cloudflare to clients, obtained via Logpull API
+		# TYPE cloudflare_logs_edge_response_size_bytes histogram
+		cloudflare_logs_edge_response_size_bytes_bucket{client_request_host="example.org",zone_id="zone",zone_name="",le="1000"} 2
+		cloudflare_logs_edge_response_size_bytes_bucket{client_request_host="example.org",zone_id="zone",zone_name="",le="+Inf"} 3
+		cloudflare_logs_edge_response_size_bytes_sum{client_request_host="example.org",zone_id="zone",zone_name=""} 4500
+		cloudflare_logs_edge_response_size_bytes_count{client_request_host="example.org",zone_id="zone",zone_name=""} 3
+	`)
+
+	if err := testutil.CollectAndCompare(c, expected,
+		"cloudflare_logs_client_request_bytes_total",
+		"cloudflare_logs_edge_response_bytes_total",
+		"cloudflare_logs_edge_response_size_bytes",
+	); err != nil {
+		t.Error(err)
+	}
+
+	cfg.sizeBuckets = nil
+	c, err = newCollector(api, []zone{{id: "zone"}}, cfg, func(error) {})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	c.pull(context.Background())
+
+	if n := testutil.CollectAndCount(c, "cloudflare_logs_edge_response_size_bytes"); n != 0 {
+		t.Errorf("expected no size histograms without size buckets, got %d", n)
+	}
+}
+
+// TestCacheMetrics checks that requests and cache response bytes are counted
+// per host and cache status.
+func TestCacheMetrics(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jsonBody := []byte(`{"ClientRequestHost": "example.org", "CacheCacheStatus": "hit", "CacheResponseBytes": 1000}` + "\n" +
+			`{"ClientRequestHost": "example.org", "CacheCacheStatus": "hit", "CacheResponseBytes": 2000}` + "\n" +
+			`{"ClientRequestHost": "example.org", "CacheCacheStatus": "miss", "CacheResponseBytes": 500}` + "\n" +
+			`{"ClientRequestHost": "example.org"}` + "\n")
+		if _, err := w.Write(jsonBody); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}))
+	defer ts.Close()
+
+	api := newLogpullAPI("", "")
+	api.setAPIProperties(ts.URL, ts.Client())
+
+	c, err := newCollector(api, []zone{{id: "zone"}}, collectorConfig{logPeriod: time.Minute, metricFamilies: []string{"cache"}}, func(err error) {
+		t.Errorf("unexpected error: %s", err)
+	})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	c.pull(context.Background())
+
+	expected := strings.NewReader(`
+		# HELP cloudflare_logs_cache_requests Cloudflare HTTP requests by cache status, obtained via Logpull API
+		# TYPE cloudflare_logs_cache_requests gauge
+		cloudflare_logs_cache_requests{cache_status="hit",client_request_host="example.org",period="1m",zone_id="zone",zone_name=""} 2
+		cloudflare_logs_cache_requests{cache_status="miss",client_request_host="example.org",period="1m",zone_id="zone",zone_name=""} 1
+		# HELP cloudflare_logs_cache_response_bytes Bytes served by the Cloudflare cache by cache status, obtained via Logpull API
+		# TYPE cloudflare_logs_cache_response_bytes gauge
+		cloudflare_logs_cache_response_bytes{cache_status="hit",client_request_host="example.org",period="1m",zone_id="zone",zone_name=""} 3000
+		cloudflare_logs_cache_response_bytes{cache_status="miss",client_request_host="example.org",period="1m",zone_id="zone",zone_name=""} 500
+	`)
+
+	if err := testutil.CollectAndCompare(c, expected,
+		"cloudflare_logs_cache_requests",
+		"cloudflare_logs_cache_response_bytes",
+	); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestFirewallMetrics checks that WAF actions and each distinct action of
+// the FirewallMatchesActions array are counted per host.
+func TestFirewallMetrics(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jsonBody := []byte(`{"ClientRequestHost": "example.org", "WAFAction": "block", "FirewallMatchesActions": ["log", "block", "block"], "SecurityLevel": "high"}` + "\n" +
+			`{"ClientRequestHost": "example.org", "WAFAction": "unknown", "FirewallMatchesActions": ["challenge"], "SecurityLevel": "high"}` + "\n" +
+			`{"ClientRequestHost": "example.org", "WAFAction": "unknown", "FirewallMatchesActions": [], "SecurityLevel": "high"}` + "\n")
+		if _, err := w.Write(jsonBody); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}))
+	defer ts.Close()
+
+	api := newLogpullAPI("", "")
+	api.setAPIProperties(ts.URL, ts.Client())
+
+	c, err := newCollector(api, []zone{{id: "zone"}}, collectorConfig{logPeriod: time.Minute, metricFamilies: []string{"firewall"}}, func(err error) {
+		t.Errorf("unexpected error: %s", err)
+	})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	c.pull(context.Background())
+
+	expected := strings.NewReader(`
+		# HELP cloudflare_logs_firewall_actions Cloudflare HTTP requests by firewall action taken and security level, obtained via Logpull API
+		# TYPE cloudflare_logs_firewall_actions gauge
+		cloudflare_logs_firewall_actions{action="block",client_request_host="example.org",period="1m",security_level="high",zone_id="zone",zone_name=""} 1
+		cloudflare_logs_firewall_actions{action="challenge",client_request_host="example.org",period="1m",security_level="high",zone_id="zone",zone_name=""} 1
+		cloudflare_logs_firewall_actions{action="log",client_request_host="example.org",period="1m",security_level="high",zone_id="zone",zone_name=""} 1
+		# HELP cloudflare_logs_waf_actions Cloudflare HTTP requests by WAF action taken, obtained via Logpull API
+		# TYPE cloudflare_logs_waf_actions gauge
+		cloudflare_logs_waf_actions{action="block",client_request_host="example.org",period="1m",zone_id="zone",zone_name=""} 1
+	`)
+
+	if err := testutil.CollectAndCompare(c, expected,
+		"cloudflare_logs_firewall_actions",
+		"cloudflare_logs_waf_actions",
+	); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestBotScoreHistogram checks that bot scores are observed per host and
+// source, and that entries without a bot score are ignored rather than
+// treated as errors.
+func TestBotScoreHistogram(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jsonBody := []byte(`{"ClientRequestHost": "example.org", "BotScore": 1, "BotScoreSrc": "Heuristics"}` + "\n" +
+			`{"ClientRequestHost": "example.org", "BotScore": "30", "BotScoreSrc": "Heuristics"}` + "\n" +
+			`{"ClientRequestHost": "example.org", "BotScore": 0, "BotScoreSrc": "Not Computed"}` + "\n" +
+			`{"ClientRequestHost": "example.org", "BotScore": null, "BotScoreSrc": null}` + "\n" +
+			`{"ClientRequestHost": "example.org"}` + "\n")
+		if _, err := w.Write(jsonBody); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}))
+	defer ts.Close()
+
+	api := newLogpullAPI("", "")
+	api.setAPIProperties(ts.URL, ts.Client())
+
+	c, err := newCollector(api, []zone{{id: "zone"}}, collectorConfig{logPeriod: time.Minute, metricFamilies: []string{"bot"}}, func(err error) {
+		t.Errorf("unexpected error: %s", err)
+	})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	c.pull(context.Background())
+
+	expected := strings.NewReader(`
+		# HELP cloudflare_logs_bot_score Bot Management scores of Cloudflare HTTP requests, obtained via Logpull API
+		# TYPE cloudflare_logs_bot_score histogram
+		cloudflare_logs_bot_score_bucket{bot_score_source="Heuristics",client_request_host="example.org",period="1m",zone_id="zone",zone_name="",le="1"} 1
+		cloudflare_logs_bot_score_bucket{bot_score_source="Heuristics",client_request_host="example.org",period="1m",zone_id="zone",zone_name="",le="10"} 1
+		cloudflare_logs_bot_score_bucket{bot_score_source="Heuristics",client_request_host="example.org",period="1m",zone_id="zone",zone_name="",le="20"} 1
+		cloudflare_logs_bot_score_bucket{bot_score_source="Heuristics",client_request_host="example.org",period="1m",zone_id="zone",zone_name="",le="29"} 1
+		cloudflare_logs_bot_score_bucket{bot_score_source="Heuristics",client_request_host="example.org",period="1m",zone_id="zone",zone_name="",le="50"} 2
+		cloudflare_logs_bot_score_bucket{bot_score_source="Heuristics",client_request_host="example.org",period="1m",zone_id="zone",zone_name="",le="75"} 2
+		cloudflare_logs_bot_score_bucket{bot_score_source="Heuristics",client_request_host="example.org",period="1m",zone_id="zone",zone_name="",le="99"} 2
+		cloudflare_logs_bot_score_bucket{bot_score_source="Heuristics",client_request_host="example.org",period="1m",zone_id="zone",zone_name="",le="+Inf"} 2
+		cloudflare_logs_bot_score_sum{bot_score_source="Heuristics",client_request_host="example.org",period="1m",zone_id="zone",zone_name=""} 31
+		cloudflare_logs_bot_score_count{bot_score_source="Heuristics",client_request_host="example.org",period="1m",zone_id="zone",zone_name=""} 2
+	`)
+
+	if err := testutil.CollectAndCompare(c, expected, "cloudflare_logs_bot_score"); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestCountryTopN checks that ClientCountry is added to the labels of the
+// HTTP responses metric, and that countries outside the top N are reported
+// as "other".
+func TestCountryTopN(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var lines []string
+		for _, country := range []string{"us", "us", "us", "gb", "gb", "de", "fr"} {
+			lines = append(lines, `{"ClientRequestHost": "example.org", "ClientCountry": "`+country+`"}`)
+		}
+		if _, err := w.Write([]byte(strings.Join(lines, "\n") + "\n")); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}))
+	defer ts.Close()
+
+	api := newLogpullAPI("", "")
+	api.setAPIProperties(ts.URL, ts.Client())
+
+	cfg := collectorConfig{
+		logPeriod:   time.Minute,
+		labelFields: []string{"ClientRequestHost"},
+		countryTopN: 2,
+	}
+	c, err := newCollector(api, []zone{{id: "zone"}}, cfg, func(err error) {
+		t.Errorf("unexpected error: %s", err)
+	})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	c.pull(context.Background())
+
+	expected := strings.NewReader(`
+		# HELP cloudflare_logs_http_responses Cloudflare HTTP responses, obtained via Logpull API
+		# TYPE cloudflare_logs_http_responses gauge
+		cloudflare_logs_http_responses{client_country="gb",client_request_host="example.org",period="1m",zone_id="zone",zone_name=""} 2
+		cloudflare_logs_http_responses{client_country="other",client_request_host="example.org",period="1m",zone_id="zone",zone_name=""} 2
+		cloudflare_logs_http_responses{client_country="us",client_request_host="example.org",period="1m",zone_id="zone",zone_name=""} 3
+	`)
+
+	if err := testutil.CollectAndCompare(c, expected, "cloudflare_logs_http_responses"); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestCapCountriesSticky checks that a country which has been reported by
+// name keeps being reported by name after it drops out of the top N.
+func TestCapCountriesSticky(t *testing.T) {
+	m, err := newLogMetrics(collectorConfig{
+		logPeriod:   time.Minute,
+		windowMode:  windowContiguous,
+		labelFields: []string{"ClientCountry"},
+		countryTopN: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc := newCountryCap()
+
+	first := newAggregation()
+	first.add(m.responses, newLabelSet("us"), 2)
+	first.add(m.responses, newLabelSet("gb"), 1)
+	m.capCountries(first, cc)
+
+	second := newAggregation()
+	second.add(m.responses, newLabelSet("us"), 1)
+	second.add(m.responses, newLabelSet("gb"), 5)
+	second.add(m.responses, newLabelSet("de"), 1)
+	m.capCountries(second, cc)
+
+	expected := map[labelSet]float64{
+		newLabelSet("us"):         1,
+		newLabelSet("gb"):         5,
+		newLabelSet(otherCountry): 1,
+	}
+
+	if len(second.values) != len(expected) {
+		t.Errorf("expected %d series, got %d", len(expected), len(second.values))
+	}
+
+	for labels, v := range expected {
+		if got := second.values[seriesKey{m.responses, labels}]; got != v {
+			t.Errorf("%s: expected %v, got %v", labels, v, got)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// otherRoute is the route of request paths which match no route rule.
+const otherRoute = "other"
+
+// routeLabel is the label of the HTTP responses metric which holds the route
+// of the request, if route rules are configured.
+const routeLabel = "route"
+
+// routeRegexpSeparator separates the route from the regular expression of a
+// regular expression route rule.
+const routeRegexpSeparator = "=~"
+
+// routePlaceholderRegexp matches the placeholders of a path template, such as
+// {id}, or {path...} to match the remainder of a path.
+var routePlaceholderRegexp = regexp.MustCompile(`^\{[A-Za-z_][A-Za-z0-9_]*(\.\.\.)?\}$`)
+
+// routeRule maps request paths which match pattern onto route.
+type routeRule struct {
+	pattern *regexp.Regexp
+	route   string
+}
+
+// parseRouteRule parses a single route rule, which is either a path template
+// or a regular expression.
+//
+// A path template, such as /users/{id}/posts, is its own route. Each {name}
+// placeholder matches exactly one path segment, and a final {name...}
+// placeholder matches the remainder of the path. A trailing slash in the path
+// is ignored.
+//
+// A regular expression rule takes the form route=~regexp, e.g.
+// /static=~^/(css|js|img)/, and maps every path matching regexp onto route.
+func parseRouteRule(rule string) (routeRule, error) {
+	if i := strings.Index(rule, routeRegexpSeparator); i >= 0 {
+		route, expr := rule[:i], rule[i+len(routeRegexpSeparator):]
+		if route == "" {
+			return routeRule{}, fmt.Errorf("route rule %q: route must not be empty", rule)
+		}
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return routeRule{}, fmt.Errorf("route rule %q: %w", rule, err)
+		}
+		return routeRule{pattern, route}, nil
+	}
+
+	if !strings.HasPrefix(rule, "/") {
+		return routeRule{}, fmt.Errorf("route rule %q: path templates must start with '/'", rule)
+	}
+
+	segments := strings.Split(strings.TrimSuffix(rule[1:], "/"), "/")
+	var expr strings.Builder
+	expr.WriteString("^")
+
+	for i, segment := range segments {
+		expr.WriteString("/")
+
+		switch {
+		case !strings.Contains(segment, "{"):
+			expr.WriteString(regexp.QuoteMeta(segment))
+		case !routePlaceholderRegexp.MatchString(segment):
+			return routeRule{}, fmt.Errorf("route rule %q: invalid placeholder %q", rule, segment)
+		case strings.HasSuffix(segment, "...}"):
+			if i != len(segments)-1 {
+				return routeRule{}, fmt.Errorf("route rule %q: %q must be the final segment", rule, segment)
+			}
+			expr.WriteString(".*")
+		default:
+			expr.WriteString("[^/]+")
+		}
+	}
+
+	expr.WriteString("/?$")
+
+	return routeRule{regexp.MustCompile(expr.String()), rule}, nil
+}
+
+// routeNormalizer maps request URIs onto a bounded set of routes, so that
+// they can be used as a label without unbounded cardinality.
+type routeNormalizer struct {
+	rules []routeRule
+}
+
+// newRouteNormalizer creates a routeNormalizer from the given route rules,
+// which are tried in order. Returns an error if any rule is invalid.
+func newRouteNormalizer(rules []string) (*routeNormalizer, error) {
+	n := &routeNormalizer{}
+	for _, rule := range rules {
+		r, err := parseRouteRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		n.rules = append(n.rules, r)
+	}
+	return n, nil
+}
+
+// route returns the route of the first rule matching the path of the given
+// request URI, ignoring its query string, or otherRoute if no rule matches.
+func (n *routeNormalizer) route(uri string) string {
+	path := uri
+	if i := strings.IndexAny(path, "?#"); i >= 0 {
+		path = path[:i]
+	}
+
+	for _, rule := range n.rules {
+		if rule.pattern.MatchString(path) {
+			return rule.route
+		}
+	}
+
+	return otherRoute
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestRouteNormalizer checks that request URIs are mapped onto the route of
+// the first matching rule, ignoring query strings, and onto "other" if no
+// rule matches.
+func TestRouteNormalizer(t *testing.T) {
+	n, err := newRouteNormalizer([]string{
+		"/users/{id}",
+		"/users/{id}/posts/{postID}",
+		"/static=~^/(css|js)/",
+		"/files/{path...}",
+		"/",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := map[string]string{
+		"/users/42":             "/users/{id}",
+		"/users/42/":            "/users/{id}",
+		"/users/42?tab=profile": "/users/{id}",
+		"/users/42/posts/7":     "/users/{id}/posts/{postID}",
+		"/users/42/friends":     "other",
+		"/users":                "other",
+		"/css/site.css":         "/static",
+		"/files/a/b/c.txt":      "/files/{path...}",
+		"/":                     "/",
+		"/?q=1":                 "/",
+		"/about":                "other",
+		"":                      "other",
+	}
+
+	for uri, expected := range testCases {
+		if got := n.route(uri); got != expected {
+			t.Errorf("%q: expected route %q, got %q", uri, expected, got)
+		}
+	}
+}
+
+// TestInvalidRouteRules checks that malformed route rules are rejected.
+func TestInvalidRouteRules(t *testing.T) {
+	for _, rule := range []string{
+		"users/{id}",
+		"/users/{id",
+		"/users/{a-b}",
+		"/files/{path...}/edit",
+		"=~^/static/",
+		"/static=~(",
+	} {
+		if _, err := newRouteNormalizer([]string{rule}); err == nil {
+			t.Errorf("expected error with route rule %q", rule)
+		}
+	}
+}
+
+// TestCollectorRoutes checks that the HTTP responses metric gains a route
+// label when route rules are configured.
+func TestCollectorRoutes(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fields := r.URL.Query().Get("fields"); !strings.Contains(fields, "ClientRequestURI") {
+			t.Errorf("expected ClientRequestURI to be requested, got %s", fields)
+		}
+		jsonBody := []byte(`{"ClientRequestHost": "example.org", "ClientRequestURI": "/users/1"}` + "\n" +
+			`{"ClientRequestHost": "example.org", "ClientRequestURI": "/users/2?x=y"}` + "\n" +
+			`{"ClientRequestHost": "example.org", "ClientRequestURI": "/wp-login.php"}` + "\n")
+		if _, err := w.Write(jsonBody); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}))
+	defer ts.Close()
+
+	api := newLogpullAPI("", "")
+	api.setAPIProperties(ts.URL, ts.Client())
+
+	cfg := collectorConfig{
+		logPeriod:   time.Minute,
+		labelFields: []string{"ClientRequestHost"},
+		routes:      []string{"/users/{id}"},
+	}
+	c, err := newCollector(api, []zone{{id: "zone"}}, cfg, func(err error) {
+		t.Errorf("unexpected error: %s", err)
+	})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	c.pull(context.Background())
+
+	expected := strings.NewReader(`
+		# HELP cloudflare_logs_http_responses Cloudflare HTTP responses, obtained via Logpull API
+		# TYPE cloudflare_logs_http_responses gauge
+		cloudflare_logs_http_responses{client_request_host="example.org",period="1m",route="/users/{id}",zone_id="zone",zone_name=""} 2
+		cloudflare_logs_http_responses{client_request_host="example.org",period="1m",route="other",zone_id="zone",zone_name=""} 1
+	`)
+
+	if err := testutil.CollectAndCompare(c, expected, "cloudflare_logs_http_responses"); err != nil {
+		t.Error(err)
+	}
+}
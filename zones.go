@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+)
+
+// The IDs of zones which cannot be resolved are retried with exponential
+// backoff, starting at minResolveBackoff and capped at maxResolveBackoff.
+const (
+	minResolveBackoff = 30 * time.Second
+	maxResolveBackoff = 10 * time.Minute
+)
+
+// zoneLookupTimeout bounds the lookup of the ID of a single zone, and each
+// discovery of zones, so that a stalled Cloudflare API cannot hold up the
+// zoneManager.
+const zoneLookupTimeout = 30 * time.Second
+
+// zoneIDRegexp matches Cloudflare zone IDs.
+var zoneIDRegexp = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// zoneManager keeps the zones of a collector up to date. It resolves the IDs
+// of the configured zones from their names, retrying those which cannot be
+// resolved, and adds any zones found by zone discovery.
+type zoneManager struct {
+	api *cloudflare.API
+	// configured are the statically configured zones. A zone whose ID is
+	// empty has not been resolved yet.
+	configured []zone
+	// discovery, if not nil, discovers further zones, which are stored in
+	// discovered.
+	discovery  *zoneDiscovery
+	discovered []zone
+}
+
+// newZoneManager creates a new zoneManager. Configured zones whose ID is
+// empty are resolved by name, and discovery may be nil.
+func newZoneManager(api *cloudflare.API, configured []zone, discovery *zoneDiscovery) *zoneManager {
+	return &zoneManager{
+		api:        api,
+		configured: append([]zone(nil), configured...),
+		discovery:  discovery,
+	}
+}
+
+// resolve looks up the IDs of the configured zones which have not been
+// resolved yet, until ctx is done. A zone which cannot be resolved is left
+// unresolved, and an error is passed to errorHandler.
+func (m *zoneManager) resolve(ctx context.Context, errorHandler func(string, error)) {
+	for i, z := range m.configured {
+		if z.id != "" {
+			continue
+		}
+
+		id, err := m.lookupZoneID(ctx, z.name)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			errorHandler("", &apiError{
+				class: errorClassZoneResolution,
+				err:   fmt.Errorf("resolving zone %s: %w", z.name, err),
+			})
+			continue
+		}
+		m.configured[i].id = id
+	}
+}
+
+// lookupZoneID returns the ID of the zone with the given name, giving up after
+// zoneLookupTimeout.
+func (m *zoneManager) lookupZoneID(ctx context.Context, name string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, zoneLookupTimeout)
+	defer cancel()
+
+	resp, err := m.api.ListZonesContext(ctx, cloudflare.WithZoneFilters(name, "", ""))
+	if err != nil {
+		return "", fmt.Errorf("listing zones: %w", err)
+	}
+
+	for _, cz := range resp.Result {
+		if strings.EqualFold(cz.Name, name) {
+			return cz.ID, nil
+		}
+	}
+	return "", errors.New("zone not found")
+}
+
+// unresolved reports whether any configured zones have not been resolved.
+func (m *zoneManager) unresolved() bool {
+	for _, z := range m.configured {
+		if z.id == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// discover replaces the discovered zones with those currently found by zone
+// discovery, giving up after zoneLookupTimeout. If discovery fails, the
+// previously discovered zones are kept, and an error is passed to
+// errorHandler. Nothing is reported if ctx is done.
+func (m *zoneManager) discover(ctx context.Context, errorHandler func(string, error)) {
+	if m.discovery == nil {
+		return
+	}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, zoneLookupTimeout)
+	defer cancel()
+
+	zones, err := m.discovery.discover(lookupCtx)
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		errorHandler("", &apiError{
+			class: errorClassZoneDiscovery,
+			err:   fmt.Errorf("discovering zones: %w", err),
+		})
+		return
+	}
+	m.discovered = zones
+}
+
+// zones returns the configured zones, including those which have not been
+// resolved, followed by the discovered zones. Configured zones take
+// precedence over discovered zones with the same ID or name, so that their
+// filters are kept. A zone which is configured by name, and has not been
+// resolved yet, takes its ID from a discovered zone of the same name. A zone
+// which is configured both by name and by ID is returned once, with the
+// settings of its first entry.
+func (m *zoneManager) zones() []zone {
+	zones := make([]zone, 0, len(m.configured)+len(m.discovered))
+
+	discoveredIDs := make(map[string]string, len(m.discovered))
+	for _, z := range m.discovered {
+		discoveredIDs[z.name] = z.id
+	}
+
+	seen := make(map[string]bool, 2*len(m.configured))
+	for _, z := range m.configured {
+		if z.id == "" {
+			z.id = discoveredIDs[z.name]
+		}
+		if z.id != "" && seen[z.id] {
+			continue
+		}
+		zones = append(zones, z)
+
+		if z.id != "" {
+			seen[z.id] = true
+		}
+		if z.name != "" {
+			seen[z.name] = true
+		}
+	}
+
+	for _, z := range m.discovered {
+		if !seen[z.id] && !seen[z.name] {
+			zones = append(zones, z)
+		}
+	}
+
+	return zones
+}
+
+// update resolves and discovers zones once, and sets them as the zones of the
+// given collector. Errors are reported by the collector.
+func (m *zoneManager) update(ctx context.Context, c *collector) {
+	m.resolve(ctx, c.reportError)
+	m.discover(ctx, c.reportError)
+	c.setZones(m.zones())
+}
+
+// run keeps the zones of the given collector up to date until ctx is done.
+// Unresolved zones are retried with exponential backoff, and zones are
+// discovered once every discovery interval.
+func (m *zoneManager) run(ctx context.Context, c *collector) {
+	backoff := minResolveBackoff
+
+	resolveTimer := time.NewTimer(backoff)
+	defer resolveTimer.Stop()
+	if !m.unresolved() {
+		resolveTimer.Stop()
+	}
+
+	var discoverC <-chan time.Time
+	if m.discovery != nil {
+		ticker := time.NewTicker(m.discovery.interval)
+		defer ticker.Stop()
+		discoverC = ticker.C
+	}
+
+	for {
+		select {
+		case <-resolveTimer.C:
+			m.resolve(ctx, c.reportError)
+			if m.unresolved() {
+				if backoff *= 2; backoff > maxResolveBackoff {
+					backoff = maxResolveBackoff
+				}
+				resolveTimer.Reset(backoff)
+			}
+		case <-discoverC:
+			m.discover(ctx, c.reportError)
+		case <-ctx.Done():
+			return
+		}
+
+		c.setZones(m.zones())
+	}
+}
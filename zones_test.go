@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestZoneManagerResolve checks that zones which cannot be resolved are left
+// unresolved and retried, while the other zones are resolved and pulled.
+func TestZoneManagerResolve(t *testing.T) {
+	var mu sync.Mutex
+	unavailable := map[string]bool{"example.com": true}
+
+	cfts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		name := r.URL.Query().Get("name")
+		if unavailable[name] {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"success": false, "errors": [{"code": 9109, "message": "Unauthorized to access requested resource"}]}`)
+			return
+		}
+		id := strings.Repeat(name[len(name)-1:], 32)
+		fmt.Fprintf(w, `{"success": true, "result": [{"id": %q, "name": %q}]}`, id, name)
+	}))
+	defer cfts.Close()
+
+	cfapi, err := cloudflare.New("key", "email", cloudflare.HTTPClient(cfts.Client()), cloudflare.UsingRateLimit(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfapi.BaseURL = cfts.URL
+
+	lpts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jsonBody := []byte(`{"ClientRequestHost": "example.org", "EdgeResponseStatus": 200, "OriginResponseStatus": 200}` + "\n")
+		if _, err := w.Write(jsonBody); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}))
+	defer lpts.Close()
+
+	api := newLogpullAPI("", "")
+	api.setAPIProperties(lpts.URL, lpts.Client())
+
+	var errs []error
+	c, err := newCollector(api, nil, collectorConfig{logPeriod: time.Minute}, func(err error) {
+		errs = append(errs, err)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	m := newZoneManager(cfapi, []zone{{name: "example.org"}, {name: "example.com"}}, nil)
+	m.update(context.Background(), c)
+
+	if len(errs) != 1 || !m.unresolved() {
+		t.Errorf("expected example.com to be unresolved, got errors %v", errs)
+	}
+
+	c.pull(context.Background())
+
+	expected := `
+		# HELP cloudflare_logs_http_responses Cloudflare HTTP responses, obtained via Logpull API
+		# TYPE cloudflare_logs_http_responses gauge
+		cloudflare_logs_http_responses{client_request_host="example.org",edge_response_status="200",origin_response_status="200",period="1m",zone_id="gggggggggggggggggggggggggggggggg",zone_name="example.org"} 1
+		# HELP cloudflare_logs_zone_resolved Whether the ID of a zone configured by name has been resolved, so that its logs are pulled
+		# TYPE cloudflare_logs_zone_resolved gauge
+		cloudflare_logs_zone_resolved{zone_name="example.com"} 0
+		cloudflare_logs_zone_resolved{zone_name="example.org"} 1
+	`
+
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected), "cloudflare_logs_http_responses", "cloudflare_logs_zone_resolved"); err != nil {
+		t.Error(err)
+	}
+
+	mu.Lock()
+	unavailable["example.com"] = false
+	mu.Unlock()
+
+	m.update(context.Background(), c)
+
+	if m.unresolved() {
+		t.Errorf("expected all zones to be resolved")
+	}
+
+	ids := []string{strings.Repeat("g", 32), strings.Repeat("m", 32)}
+	for i, z := range m.zones() {
+		if z.id != ids[i] {
+			t.Errorf("expected zone %s to have ID %s, got %s", z.name, ids[i], z.id)
+		}
+	}
+}
+
+// TestZoneManagerResolveStalled checks that resolving zones stops once ctx is
+// done, however long the Cloudflare API takes to respond, and that zones are
+// reported as unresolved until then.
+func TestZoneManagerResolveStalled(t *testing.T) {
+	stop := make(chan struct{})
+	cfts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-stop:
+		}
+	}))
+	defer cfts.Close()
+	defer close(stop)
+
+	cfapi, err := cloudflare.New("key", "email", cloudflare.HTTPClient(cfts.Client()), cloudflare.UsingRateLimit(1000), cloudflare.UsingRetryPolicy(0, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfapi.BaseURL = cfts.URL
+
+	m := newZoneManager(cfapi, []zone{{name: "example.org"}}, nil)
+
+	var errs []error
+	c, err := newCollector(newLogpullAPI("", ""), m.zones(), collectorConfig{logPeriod: time.Minute}, func(err error) {
+		errs = append(errs, err)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := `
+		# HELP cloudflare_logs_zone_resolved Whether the ID of a zone configured by name has been resolved, so that its logs are pulled
+		# TYPE cloudflare_logs_zone_resolved gauge
+		cloudflare_logs_zone_resolved{zone_name="example.org"} 0
+	`
+
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected), "cloudflare_logs_zone_resolved"); err != nil {
+		t.Error(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	started := time.Now()
+	m.update(ctx, c)
+
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("expected update to stop once ctx is done, took %s", elapsed)
+	}
+
+	if !m.unresolved() || len(errs) != 0 {
+		t.Errorf("expected example.org to be unresolved without errors, got errors %v", errs)
+	}
+}
+
+// TestZoneManagerZones checks that configured zones take precedence over
+// discovered zones with the same ID or name, that an unresolved zone takes
+// its ID from a discovered zone of the same name, and that a zone configured
+// both by name and by ID is only returned once.
+func TestZoneManagerZones(t *testing.T) {
+	m := newZoneManager(nil, []zone{{name: "example.org"}, {name: "example.com", sampleRate: 0.5}, {id: "3"}, {id: "1"}, {name: "example.dev"}}, nil)
+	m.configured[0].id = "1"
+	m.discovered = []zone{{id: "1", name: "example.org"}, {id: "2", name: "example.com"}, {id: "3", name: "example.net"}, {id: "4", name: "example.io"}}
+
+	var ids []string
+	for _, z := range m.zones() {
+		ids = append(ids, fmt.Sprintf("%s:%s:%g", z.id, z.name, z.sampleRate))
+	}
+
+	expected := []string{"1:example.org:0", "2:example.com:0.5", "3::0", ":example.dev:0", "4:example.io:0"}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Errorf("expected zones %v, got %v", expected, ids)
+	}
+}